@@ -0,0 +1,142 @@
+package servotron
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type cachedFile struct {
+	content []byte
+	modTime time.Time
+	size    int64
+	err     error
+}
+
+// fileCache holds SQL files and parsed templates in memory
+// NOTE missing SQL files are cached too so version chain lookups stay in memory
+// NOTE missing request files are not cached, so requests for missing paths cannot grow the cache
+// NOTE any file change drops every parsed template
+type fileCache struct {
+	mu        sync.RWMutex
+	files     map[string]cachedFile
+	templates map[string]*template.Template
+}
+
+func NewFileCache() *fileCache {
+	return &fileCache{
+		files:     make(map[string]cachedFile),
+		templates: make(map[string]*template.Template),
+	}
+}
+
+// ReadFile returns the file content, reading it from disk on a cache miss
+// NOTE only for paths from the config and the routes, missing files are cached
+func (c *fileCache) ReadFile(path string) ([]byte, error) {
+	return c.read(path, true)
+}
+
+// ReadRequestFile returns the file content of a path derived from the request URL
+func (c *fileCache) ReadRequestFile(path string) ([]byte, error) {
+	return c.read(path, false)
+}
+
+func (c *fileCache) read(path string, cacheMissing bool) ([]byte, error) {
+	c.mu.RLock()
+	f, ok := c.files[path]
+	c.mu.RUnlock()
+	if ok {
+		return f.content, f.err
+	}
+	f = loadFile(path)
+	if f.err == nil || (cacheMissing && errors.Is(f.err, fs.ErrNotExist)) {
+		c.mu.Lock()
+		c.files[path] = f
+		c.mu.Unlock()
+	}
+	return f.content, f.err
+}
+
+func loadFile(path string) cachedFile {
+	info, err := os.Stat(path)
+	if err != nil {
+		return cachedFile{err: err}
+	}
+	content, err := os.ReadFile(path)
+	return cachedFile{
+		content: content,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		err:     err,
+	}
+}
+
+// Template returns the cached template for the key, parsing it on a cache miss
+func (c *fileCache) Template(key string, parse func() (*template.Template, error)) (*template.Template, error) {
+	c.mu.RLock()
+	tmpl, ok := c.templates[key]
+	c.mu.RUnlock()
+	if ok {
+		return tmpl, nil
+	}
+	tmpl, err := parse()
+	if err != nil {
+		return tmpl, err
+	}
+	c.mu.Lock()
+	c.templates[key] = tmpl
+	c.mu.Unlock()
+	return tmpl, nil
+}
+
+// Reload drops every cached file and template
+func (c *fileCache) Reload() {
+	c.mu.Lock()
+	c.files = make(map[string]cachedFile)
+	c.templates = make(map[string]*template.Template)
+	c.mu.Unlock()
+}
+
+// Watch polls the cached files on the given interval and drops changed entries
+func (c *fileCache) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.Invalidate()
+	}
+}
+
+// Invalidate drops the cached files that changed on disk since they were read
+func (c *fileCache) Invalidate() {
+	c.mu.RLock()
+	cached := make(map[string]cachedFile, len(c.files))
+	for path, f := range c.files {
+		cached[path] = f
+	}
+	c.mu.RUnlock()
+	var changed []string
+	for path, f := range cached {
+		info, err := os.Stat(path)
+		switch {
+		case err != nil && f.err != nil:
+			continue
+		case err == nil && f.err == nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size:
+			continue
+		}
+		changed = append(changed, path)
+	}
+	if len(changed) == 0 {
+		return
+	}
+	c.mu.Lock()
+	for _, path := range changed {
+		log.Println("fileCache", "invalidating", path)
+		delete(c.files, path)
+	}
+	c.templates = make(map[string]*template.Template)
+	c.mu.Unlock()
+}
@@ -1,6 +1,4 @@
 // TODO MySQL support
-// TODO ingest OpenAPI specs for routes
-// TODO connection pools for multiple databases (reader, writer)
 // TODO consider prepared stmt handling
 
 package main
@@ -17,6 +15,7 @@ import (
 
 func main() {
 	configFilePath := flag.String("config", "", "config file path")
+	routesFilePath := flag.String("routes", "", "routes file path, routes JSON or an OpenAPI 3 document")
 	flag.Parse()
 	configBytes, err := os.ReadFile(*configFilePath)
 	if err != nil {
@@ -32,10 +31,28 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("connected to database", cfg.DBConnString)
+	if *routesFilePath != "" {
+		routesBytes, err := os.ReadFile(*routesFilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		routes, err := servo.GetRoutesFromBytes(routesBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = servo.LoadRouter(routes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("loaded routes from", *routesFilePath)
+	}
 	// management server listening for admin requests on management port
 	mgmtRouter := mux.NewRouter()
 	mgmtRouter.HandleFunc("/routes", servo.LoadRoutesHandler).Methods("POST")
+	mgmtRouter.HandleFunc("/reload", servo.ReloadHandler).Methods("POST")
+	if cfg.OpenAPI == "management" {
+		mgmtRouter.HandleFunc("/openapi.json", servo.OpenAPIHandler).Methods("GET")
+	}
 	mgmtServer := &http.Server{
 		Handler: mgmtRouter,
 		Addr:    ":" + cfg.ManagementPort,
@@ -3,28 +3,53 @@ package servotron
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/user"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	// file
-	Debug              bool
-	ListenPort         string
-	ManagementPort     string
-	DBConnString       string
-	DBPoolSize         int
-	DBQueryTimeout int
-	AppUserAuth        map[string]string
-	AppUserLocalParams map[string]string
-	SQLRoot            string
-	FileServers        map[string]string
-	TemplateServers    map[string]string
-	QueryStringAsJSON  bool
+	Debug                 bool
+	ListenPort            string
+	ManagementPort        string
+	DBConnString          string
+	DBReaderConnStrings   []string
+	DBPoolSize            int
+	DBPoolMinConns        int
+	DBPoolMaxConns        int
+	DBPoolMaxConnIdleTime int
+	DBPoolMaxConnLifetime int
+	DBPingOnAcquire       bool
+	DBAfterConnect        string
+	DBIsolationLevel      string
+	DBRetryAttempts       int
+	DBRetryBackoff        int
+	DBQueryTimeout        int
+	DBHealthCheckInterval int
+	Databases             map[string]Database
+	AuthDatabase          string
+	FileWatchInterval     int
+	AppUserAuth           map[string]string
+	AppUserLocalParams    map[string]string
+	AppUserRole           map[string]string
+	TrustedProxies        []string
+	RequestHeaders        []string
+	RequestIDHeader       string
+	SQLRoot               string
+	Versions              map[string]Version
+	DefaultVersion        string
+	FileServers           map[string]string
+	TemplateServers       map[string]string
+	QueryStringAsJSON     bool
+	StreamFlushInterval   int
+	SQLStateStatus        map[string]int
+	OpenAPI               string
 	// runtime
-	QueryParams map[string][]string
+	QueryParams map[string]QueryParams
 	Routes      []Route
 }
 
@@ -37,16 +62,36 @@ func (c *Config) Parse(b []byte) error {
 	c.ListenPort = "80"
 	c.DBConnString = "postgresql://postgres@localhost:5432/postgres"
 	c.DBPoolSize = runtime.NumCPU()
+	// NOTE pool limits default to DBPoolSize
+	c.DBPoolMinConns = -1
 	c.DBQueryTimeout = 60
+	c.DBHealthCheckInterval = 5
+	c.DBRetryAttempts = 3
+	c.DBRetryBackoff = 50
+	c.StreamFlushInterval = 200
+	c.FileWatchInterval = 2
 	c.AppUserAuth = make(map[string]string)
 	c.AppUserAuth["Claim"] = ""
 	c.AppUserAuth["Name"] = ""
+	c.AppUserAuth["Verify"] = "false"
+	c.AppUserAuth["Algorithms"] = "HS256,RS256,ES256"
+	c.AppUserAuth["RequiredClaims"] = "exp"
 	c.AppUserLocalParams = make(map[string]string)
+	c.RequestIDHeader = "X-Request-Id"
 	c.QueryStringAsJSON = true
 	err := json.Unmarshal(b, &c)
 	if err != nil {
 		return err
 	}
+	if c.DBPoolMaxConns <= 0 {
+		c.DBPoolMaxConns = c.DBPoolSize
+	}
+	if c.DBPoolMinConns < 0 {
+		c.DBPoolMinConns = c.DBPoolMaxConns
+	}
+	if c.DBPoolMaxConns < c.DBPoolMinConns {
+		return fmt.Errorf("DBPoolMinConns %d exceeds DBPoolMaxConns %d", c.DBPoolMinConns, c.DBPoolMaxConns)
+	}
 	who, err := user.Current()
 	if err != nil {
 		return err
@@ -55,6 +100,47 @@ func (c *Config) Parse(b []byte) error {
 	if err != nil {
 		return err
 	}
+	err = c.ResolveVersions()
+	if err != nil {
+		return err
+	}
+	for name := range c.Databases {
+		if name == "" {
+			return fmt.Errorf("invalid database name %q", name)
+		}
+	}
+	if _, ok := c.Databases[c.AuthDatabase]; c.AuthDatabase != "" && !ok {
+		return fmt.Errorf("unknown AuthDatabase %q", c.AuthDatabase)
+	}
+	err = c.CheckAppUserRole()
+	if err != nil {
+		return err
+	}
+	// NOTE empty is the server default_transaction_isolation
+	c.DBIsolationLevel = strings.ToLower(c.DBIsolationLevel)
+	if !IsIsolationLevel(c.DBIsolationLevel) {
+		return fmt.Errorf("invalid DBIsolationLevel %q", c.DBIsolationLevel)
+	}
+	if c.DBRetryAttempts < 1 {
+		c.DBRetryAttempts = 1
+	}
+	switch c.OpenAPI {
+	case "", "public", "management":
+	default:
+		return fmt.Errorf("invalid OpenAPI %q, expected public or management", c.OpenAPI)
+	}
+	if c.DBAfterConnect != "" {
+		c.DBAfterConnect, err = c.ResolveUserDir(who.HomeDir, c.DBAfterConnect)
+		if err != nil {
+			return err
+		}
+	}
+	if c.AppUserAuth["JWKSFile"] != "" {
+		c.AppUserAuth["JWKSFile"], err = c.ResolveUserDir(who.HomeDir, c.AppUserAuth["JWKSFile"])
+		if err != nil {
+			return err
+		}
+	}
 	for key, val := range c.FileServers {
 		c.FileServers[key], err = c.ResolveUserDir(who.HomeDir, val)
 		if err != nil {
@@ -76,6 +162,65 @@ func (c *Config) Parse(b []byte) error {
 	return err
 }
 
+// routeSQLDirs are the dirs of route SQL in a version dir
+var routeSQLDirs = []string{"auth", "select", "insert", "update", "delete", "transaction", "export"}
+
+// NOTE if Versions is not specified, then each SQLRoot subdirectory with route SQL is a version
+// NOTE helper dirs, such as dirs of shared SQL, are not versions
+func (c *Config) ResolveVersions() error {
+	if len(c.Versions) == 0 {
+		c.Versions = make(map[string]Version)
+		entries, err := os.ReadDir(c.SQLRoot)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && versionPattern.MatchString(entry.Name()) && HasRouteSQL(filepath.Join(c.SQLRoot, entry.Name())) {
+				c.Versions[entry.Name()] = Version{}
+			}
+		}
+	}
+	for name, version := range c.Versions {
+		if !versionPattern.MatchString(name) {
+			return fmt.Errorf("invalid version name %q", name)
+		}
+		if version.Sunset != "" {
+			_, err := time.Parse(time.RFC3339, version.Sunset)
+			if err != nil {
+				return fmt.Errorf("version %q: invalid Sunset: %w", name, err)
+			}
+		}
+		// walk the Extends chain checking for undeclared versions and cycles
+		seen := map[string]bool{name: true}
+		for v := version.Extends; v != ""; v = c.Versions[v].Extends {
+			if _, ok := c.Versions[v]; !ok {
+				return fmt.Errorf("%w: version %q extends %q", ErrUnknownVersion, name, v)
+			}
+			if seen[v] {
+				return fmt.Errorf("version %q has an Extends cycle", name)
+			}
+			seen[v] = true
+		}
+	}
+	if c.DefaultVersion != "" {
+		if _, ok := c.Versions[c.DefaultVersion]; !ok {
+			return fmt.Errorf("%w: default version %q", ErrUnknownVersion, c.DefaultVersion)
+		}
+	}
+	return nil
+}
+
+// HasRouteSQL reports whether the dir has any of the route SQL dirs
+func HasRouteSQL(dir string) bool {
+	for _, name := range routeSQLDirs {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Config) ResolveUserDir(homeDir, path string) (string, error) {
 	result := path
 	if strings.HasPrefix(path, "~/") {
@@ -83,3 +228,39 @@ func (c *Config) ResolveUserDir(homeDir, path string) (string, error) {
 	}
 	return filepath.Abs(result)
 }
+
+func IsIsolationLevel(isoLevel string) bool {
+	switch strings.ToLower(isoLevel) {
+	case "", "read committed", "repeatable read", "serializable":
+		return true
+	}
+	return false
+}
+
+// CheckAppUserRole checks that the role source exists and is trusted, and that there is an Allow list
+func (c *Config) CheckAppUserRole() error {
+	if len(c.AppUserRole) == 0 {
+		return nil
+	}
+	name := c.AppUserRole["Name"]
+	switch c.AppUserRole["From"] {
+	case "Claim":
+		// NOTE an unverified token could name any allowed role
+		if c.AppUserAuth["Type"] != "JWT" || c.AppUserAuth["Verify"] != "true" {
+			return fmt.Errorf("AppUserRole From Claim requires AppUserAuth Type JWT and Verify true")
+		}
+	case "LocalParam":
+		if _, ok := c.AppUserLocalParams[name]; !ok {
+			return fmt.Errorf("AppUserRole Name %q is not an AppUserLocalParams key", name)
+		}
+	default:
+		return fmt.Errorf("invalid AppUserRole From %q, expected Claim or LocalParam", c.AppUserRole["From"])
+	}
+	if name == "" {
+		return fmt.Errorf("missing AppUserRole Name")
+	}
+	if len(splitList(c.AppUserRole["Allow"])) == 0 {
+		return fmt.Errorf("missing AppUserRole Allow")
+	}
+	return nil
+}
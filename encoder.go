@@ -0,0 +1,611 @@
+package servotron
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ErrNotAcceptable is returned when no requested content type has an encoder
+var ErrNotAcceptable = errors.New("not acceptable")
+
+// Encoder writes a result set, a header of column names then one row of values at a time
+// NOTE values are json.RawMessage for JSON results and Go values for row sets
+type Encoder interface {
+	Begin(columns []string) error
+	Row(values []interface{}) error
+	End() error
+}
+
+// RawEncoder is an Encoder that also writes the JSON value of a row unchanged
+// NOTE streamed JSON rows keep all of their keys, rather than the columns of the first row
+type RawEncoder interface {
+	Encoder
+	RawRow(raw json.RawMessage) error
+}
+
+// encoders map content types to encoder constructors
+var encoders = map[string]func(w io.Writer) Encoder{
+	"application/json":     NewJSONEncoder,
+	"application/x-ndjson": NewNDJSONEncoder,
+	"text/csv":             NewCSVEncoder,
+	"application/xml":      NewXMLEncoder,
+}
+
+// formats map the format query param to content types
+var formats = map[string]string{
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv",
+	"xml":    "application/xml",
+}
+
+// contentTypeAliases map accepted media types to the content types of encoders
+var contentTypeAliases = map[string]string{
+	"*/*":                "application/json",
+	"application/*":      "application/json",
+	"application/ndjson": "application/x-ndjson",
+	"text/*":             "text/csv",
+	"text/xml":           "application/xml",
+}
+
+// RegisterEncoder adds an encoder for the content type, selected by Accept or by the format query param
+func RegisterEncoder(contentType string, format string, encoder func(w io.Writer) Encoder) {
+	encoders[contentType] = encoder
+	if format != "" {
+		formats[format] = contentType
+	}
+}
+
+// Negotiate returns the content type of the response
+// NOTE the format query param takes precedence over the Accept header, and JSON is the default
+func Negotiate(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		contentType, ok := formats[format]
+		if !ok {
+			return "", ErrNotAcceptable
+		}
+		return contentType, nil
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return "application/json", nil
+	}
+	result := ""
+	quality := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if alias, ok := contentTypeAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		if _, ok := encoders[mediaType]; ok && quality < q {
+			result = mediaType
+			quality = q
+		}
+	}
+	if result == "" {
+		return result, ErrNotAcceptable
+	}
+	return result, nil
+}
+
+// EncodeJSON converts a JSON result to the content type and writes it
+// NOTE the result is encoded before anything is written, so an error can still be reported
+func (s *servotron) EncodeJSON(w http.ResponseWriter, contentType string, b []byte) error {
+	columns, rows, err := JSONRows(b)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	encoder := encoders[contentType](&buf)
+	err = encoder.Begin(columns)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err = encoder.Row(row)
+		if err != nil {
+			return err
+		}
+	}
+	err = encoder.End()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// ErrMaxRows and ErrMaxBytes are the errors of streamed responses over the limits of the route
+var (
+	ErrMaxRows  = errors.New("response exceeds the MaxRows of the route")
+	ErrMaxBytes = errors.New("response exceeds the MaxBytes of the route")
+)
+
+// EncodeRows writes the rows as they are read, commits, then ends the encoding
+// NOTE errors before the first byte is written are returned, later errors abort the response
+// NOTE row sets are encoded from their columns, other streamed rows from the JSON object of their first column
+// NOTE JSON and NDJSON write each JSON object unchanged, other encoders take the columns from the keys of the first row
+func (s *servotron) EncodeRows(ctx context.Context, w http.ResponseWriter, contentType string, route Route, tx pgx.Tx, rows pgx.Rows) error {
+	defer rows.Close()
+	next := rows.Next()
+	if !next && rows.Err() != nil {
+		return rows.Err()
+	}
+	sw := &streamWriter{
+		w:        w,
+		maxBytes: route.MaxBytes,
+		interval: time.Duration(s.config.StreamFlushInterval) * time.Millisecond,
+	}
+	encoder := encoders[contentType](sw)
+	rawEncoder, raw := encoder.(RawEncoder)
+	raw = raw && !route.RowSet
+	var columns []string
+	values := RowValues
+	if route.RowSet {
+		for _, field := range rows.FieldDescriptions() {
+			columns = append(columns, field.Name)
+		}
+	} else if next && !raw {
+		fields, err := JSONFields(RowJSON(rows))
+		if err != nil {
+			return err
+		}
+		for _, field := range fields {
+			columns = append(columns, field.key)
+		}
+		values = JSONRowValues(columns)
+	}
+	w.Header().Set("Content-Type", contentType)
+	err := encoder.Begin(columns)
+	if err != nil {
+		return s.StreamError(sw, err)
+	}
+	n := 0
+	for ; next; next = rows.Next() {
+		n++
+		if 0 < route.MaxRows && route.MaxRows < n {
+			return s.StreamError(sw, ErrMaxRows)
+		}
+		if raw {
+			err = rawEncoder.RawRow(RowJSON(rows))
+			if err != nil {
+				return s.StreamError(sw, err)
+			}
+			continue
+		}
+		row, err := values(rows)
+		if err != nil {
+			return s.StreamError(sw, err)
+		}
+		err = encoder.Row(row)
+		if err != nil {
+			return s.StreamError(sw, err)
+		}
+	}
+	// NOTE a canceled or timed out query ends the rows early
+	if rows.Err() != nil {
+		return s.StreamError(sw, rows.Err())
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return s.StreamError(sw, err)
+	}
+	err = encoder.End()
+	if err != nil {
+		return s.StreamError(sw, err)
+	}
+	sw.Flush()
+	return nil
+}
+
+// streamWriter counts the bytes of a streamed response and flushes them periodically
+type streamWriter struct {
+	w        http.ResponseWriter
+	maxBytes int64
+	n        int64
+	interval time.Duration
+	flushed  time.Time
+}
+
+// NOTE the first write is flushed, so the client sees the status and headers without waiting
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	if 0 < sw.maxBytes && sw.maxBytes < sw.n+int64(len(b)) {
+		return 0, ErrMaxBytes
+	}
+	n, err := sw.w.Write(b)
+	sw.n += int64(n)
+	if err == nil && sw.interval <= time.Since(sw.flushed) {
+		sw.Flush()
+	}
+	return n, err
+}
+
+func (sw *streamWriter) Flush() {
+	if flusher, ok := sw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	sw.flushed = time.Now()
+}
+
+// StreamError returns the error while nothing is written, so it is written as a problem, and aborts the response once it has started
+// NOTE bytes buffered by the encoder are not written, and are dropped with the problem
+func (s *servotron) StreamError(sw *streamWriter, err error) error {
+	if sw.n == 0 {
+		return err
+	}
+	s.AbortResponse(err)
+	return nil
+}
+
+// AbortResponse logs the error and aborts a response that has started, so the client sees a truncated body
+func (s *servotron) AbortResponse(err error) {
+	log.Println("AbortResponse", err)
+	panic(http.ErrAbortHandler)
+}
+
+// RowValues returns the decoded values of the current row
+// NOTE uuids are strings and pgtype values without a JSON encoding are their driver values, such as intervals
+func RowValues(rows pgx.Rows) ([]interface{}, error) {
+	values, err := rows.Values()
+	if err != nil {
+		return values, err
+	}
+	fields := rows.FieldDescriptions()
+	for i, value := range values {
+		switch v := value.(type) {
+		case [16]byte:
+			if fields[i].DataTypeOID == pgtype.UUIDOID {
+				values[i] = pgtype.UUID{Bytes: v, Valid: true}
+			}
+		case json.Marshaler:
+		case driver.Valuer:
+			values[i], err = v.Value()
+			if err != nil {
+				return values, err
+			}
+		}
+	}
+	return values, nil
+}
+
+// RowJSON returns the JSON of the first column of the current row
+// NOTE binary jsonb has a version byte before the JSON, and SQL null is JSON null
+func RowJSON(rows pgx.Rows) json.RawMessage {
+	b := rows.RawValues()[0]
+	if b == nil {
+		return json.RawMessage("null")
+	}
+	field := rows.FieldDescriptions()[0]
+	if field.DataTypeOID == pgtype.JSONBOID && field.Format == pgx.BinaryFormatCode && 0 < len(b) {
+		b = b[1:]
+	}
+	return json.RawMessage(b)
+}
+
+// JSONRowValues returns a function of the values of the columns in the JSON object of the first column of the current row
+// NOTE keys that are not columns are dropped, and missing keys are null
+func JSONRowValues(columns []string) func(rows pgx.Rows) ([]interface{}, error) {
+	index := make(map[string]int)
+	for i, column := range columns {
+		index[column] = i
+	}
+	return func(rows pgx.Rows) ([]interface{}, error) {
+		result := make([]interface{}, len(columns))
+		fields, err := JSONFields(RowJSON(rows))
+		if err != nil {
+			return result, err
+		}
+		for _, field := range fields {
+			if i, ok := index[field.key]; ok {
+				result[i] = field.value
+			}
+		}
+		return result, nil
+	}
+}
+
+type jsonField struct {
+	key   string
+	value json.RawMessage
+}
+
+// JSONRows converts a JSON array of objects, or a single object, to columns and rows
+// NOTE columns are in the order the keys first appear, and other values are in a single value column
+func JSONRows(b []byte) ([]string, [][]interface{}, error) {
+	var columns []string
+	var rows [][]interface{}
+	var elems []json.RawMessage
+	trimmed := bytes.TrimSpace(b)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		err := json.Unmarshal(trimmed, &elems)
+		if err != nil {
+			return columns, rows, err
+		}
+	} else if 0 < len(trimmed) {
+		elems = append(elems, json.RawMessage(trimmed))
+	}
+	index := make(map[string]int)
+	var objects [][]jsonField
+	for _, elem := range elems {
+		fields, err := JSONFields(elem)
+		if err != nil {
+			return columns, rows, err
+		}
+		for _, field := range fields {
+			if _, ok := index[field.key]; !ok {
+				index[field.key] = len(columns)
+				columns = append(columns, field.key)
+			}
+		}
+		objects = append(objects, fields)
+	}
+	for _, fields := range objects {
+		row := make([]interface{}, len(columns))
+		for _, field := range fields {
+			row[index[field.key]] = field.value
+		}
+		rows = append(rows, row)
+	}
+	return columns, rows, nil
+}
+
+// JSONFields returns the fields of a JSON object in order
+// NOTE any other value is a single value field
+func JSONFields(b json.RawMessage) ([]jsonField, error) {
+	var result []jsonField
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return append(result, jsonField{"value", b}), nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	_, err := dec.Token()
+	if err != nil {
+		return result, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return result, err
+		}
+		var value json.RawMessage
+		err = dec.Decode(&value)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, jsonField{tok.(string), value})
+	}
+	return result, nil
+}
+
+// CellJSON returns the JSON of a value
+func CellJSON(v interface{}) (json.RawMessage, error) {
+	if raw, ok := v.(json.RawMessage); ok {
+		if raw == nil {
+			return json.RawMessage("null"), nil
+		}
+		return raw, nil
+	}
+	return json.Marshal(v)
+}
+
+// CellText returns the text of a value, and whether it is null
+// NOTE strings are unquoted, other values are their JSON
+func CellText(v interface{}) (string, bool, error) {
+	if v == nil {
+		return "", true, nil
+	}
+	if str, ok := v.(string); ok {
+		return str, false, nil
+	}
+	raw, err := CellJSON(v)
+	if err != nil {
+		return "", false, err
+	}
+	if string(raw) == "null" {
+		return "", true, nil
+	}
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		return str, false, nil
+	}
+	return string(raw), false, nil
+}
+
+type jsonEncoder struct {
+	w       io.Writer
+	columns [][]byte
+	rows    int
+	// NOTE ndjson writes one object per line without the enclosing array
+	lines bool
+}
+
+func NewJSONEncoder(w io.Writer) Encoder {
+	return &jsonEncoder{w: w}
+}
+
+func NewNDJSONEncoder(w io.Writer) Encoder {
+	return &jsonEncoder{w: w, lines: true}
+}
+
+func (e *jsonEncoder) Begin(columns []string) error {
+	for _, column := range columns {
+		key, err := json.Marshal(column)
+		if err != nil {
+			return err
+		}
+		e.columns = append(e.columns, key)
+	}
+	if e.lines {
+		return nil
+	}
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonEncoder) Row(values []interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, value := range values {
+		if 0 < i {
+			buf.WriteString(",")
+		}
+		raw, err := CellJSON(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(e.columns[i])
+		buf.WriteString(":")
+		buf.Write(raw)
+	}
+	buf.WriteString("}")
+	return e.RawRow(buf.Bytes())
+}
+
+// NOTE the value is compacted, so a json value with newlines is still one NDJSON line
+func (e *jsonEncoder) RawRow(raw json.RawMessage) error {
+	var buf bytes.Buffer
+	if 0 < e.rows && !e.lines {
+		buf.WriteString(",")
+	}
+	err := json.Compact(&buf, raw)
+	if err != nil {
+		return err
+	}
+	if e.lines {
+		buf.WriteString("\n")
+	}
+	e.rows++
+	_, err = e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *jsonEncoder) End() error {
+	if e.lines {
+		return nil
+	}
+	_, err := io.WriteString(e.w, "]")
+	return err
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func NewCSVEncoder(w io.Writer) Encoder {
+	return &csvEncoder{w: csv.NewWriter(w)}
+}
+
+func (e *csvEncoder) Begin(columns []string) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	return e.w.Write(columns)
+}
+
+// NOTE null is the empty field
+func (e *csvEncoder) Row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		text, _, err := CellText(value)
+		if err != nil {
+			return err
+		}
+		record[i] = text
+	}
+	err := e.w.Write(record)
+	if err != nil {
+		return err
+	}
+	// NOTE flushed per row, so streamed rows are not held in the csv buffer
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder) End() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+var xmlNamePattern = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+type xmlEncoder struct {
+	w       io.Writer
+	columns []string
+}
+
+func NewXMLEncoder(w io.Writer) Encoder {
+	return &xmlEncoder{w: w}
+}
+
+// XMLName converts a column name to an element name
+func XMLName(column string) string {
+	result := xmlNamePattern.ReplaceAllString(column, "_")
+	if result == "" || !(result[0] == '_' || ('A' <= result[0] && result[0] <= 'Z') || ('a' <= result[0] && result[0] <= 'z')) {
+		result = "_" + result
+	}
+	return result
+}
+
+func (e *xmlEncoder) Begin(columns []string) error {
+	for _, column := range columns {
+		e.columns = append(e.columns, XMLName(column))
+	}
+	_, err := io.WriteString(e.w, xml.Header+"<rows>")
+	return err
+}
+
+// NOTE null is an empty element with a null attribute
+func (e *xmlEncoder) Row(values []interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString("<row>")
+	for i, value := range values {
+		text, null, err := CellText(value)
+		if err != nil {
+			return err
+		}
+		if null {
+			buf.WriteString("<" + e.columns[i] + ` null="true"/>`)
+			continue
+		}
+		buf.WriteString("<" + e.columns[i] + ">")
+		err = xml.EscapeText(&buf, []byte(text))
+		if err != nil {
+			return err
+		}
+		buf.WriteString("</" + e.columns[i] + ">")
+	}
+	buf.WriteString("</row>")
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *xmlEncoder) End() error {
+	_, err := io.WriteString(e.w, "</rows>")
+	return err
+}
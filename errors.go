@@ -0,0 +1,142 @@
+package servotron
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DefaultSQLStateStatus maps SQLSTATE codes, or two character SQLSTATE classes, to HTTP statuses
+// NOTE entries in Config.SQLStateStatus take precedence
+var DefaultSQLStateStatus = map[string]int{
+	// integrity constraint violation
+	"23":    http.StatusConflict,
+	"23502": http.StatusUnprocessableEntity,
+	"23503": http.StatusConflict,
+	"23505": http.StatusConflict,
+	"23514": http.StatusUnprocessableEntity,
+	// data exception
+	"22":    http.StatusBadRequest,
+	"22P02": http.StatusBadRequest,
+	// invalid authorization specification
+	"28": http.StatusForbidden,
+	// transaction rollback
+	"40":    http.StatusConflict,
+	"40001": http.StatusConflict,
+	"40P01": http.StatusConflict,
+	// insufficient privilege
+	"42501": http.StatusForbidden,
+	// query canceled
+	"57014": http.StatusGatewayTimeout,
+	// raise exception
+	"P0001": http.StatusBadRequest,
+}
+
+// NOTE see RFC 7807
+type problem struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Code       string `json:"code,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+}
+
+// StatusClientClosedRequest is the status of requests canceled by the client
+// NOTE not sent, the client is gone, but logged and counted
+const StatusClientClosedRequest = 499
+
+// ErrStatus translates an error into an HTTP status
+func (s *servotron) ErrStatus(err error) int {
+	var pgErr *pgconn.PgError
+	var paramErr *ParamError
+	switch {
+	// NOTE context errors are checked first, a canceled query may also return a PgError
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded), pgconn.Timeout(err):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &pgErr):
+		return s.SQLStateStatus(pgErr.Code)
+	case errors.As(err, &paramErr):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInvalidToken):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrRoleNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrNotAcceptable):
+		return http.StatusNotAcceptable
+	case errors.Is(err, ErrMissingVersion), errors.Is(err, ErrPathOutsideRoot):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnknownVersion), errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDatabaseUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// SQLStateStatus looks up the code, then its class, in the config table and then the default table
+func (s *servotron) SQLStateStatus(code string) int {
+	keys := []string{code}
+	if 2 < len(code) {
+		keys = append(keys, code[:2])
+	}
+	for _, table := range []map[string]int{s.config.SQLStateStatus, DefaultSQLStateStatus} {
+		for _, key := range keys {
+			if status, ok := table[key]; ok {
+				return status
+			}
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// Problem builds the problem details for an error
+// NOTE detail and hint are only exposed in Debug mode
+func (s *servotron) Problem(err error) problem {
+	status := s.ErrStatus(err)
+	var paramErr *ParamError
+	result := problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+	}
+	if status == StatusClientClosedRequest {
+		result.Title = "Client Closed Request"
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		result.Code = pgErr.Code
+		result.Constraint = pgErr.ConstraintName
+		if s.config.Debug {
+			result.Detail = pgErr.Message
+			if pgErr.Detail != "" {
+				result.Detail += ": " + pgErr.Detail
+			}
+			result.Hint = pgErr.Hint
+		}
+	} else if errors.As(err, &paramErr) {
+		// NOTE the offending param is always exposed
+		result.Detail = paramErr.Error()
+	} else if s.config.Debug {
+		result.Detail = err.Error()
+	}
+	return result
+}
+
+func (s *servotron) WriteProblem(w http.ResponseWriter, err error) {
+	body, marshalErr := json.Marshal(s.Problem(err))
+	if marshalErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(s.ErrStatus(err))
+	w.Write(body)
+}
@@ -0,0 +1,2 @@
+-- any app user can create a bucket
+select current_setting('app_user.id')<>'' and $1::json is not null
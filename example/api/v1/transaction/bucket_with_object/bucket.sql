@@ -0,0 +1,5 @@
+-- step params are listed in the manifest
+-- the request body is the only param
+insert into bucket(name)
+select $1::json->>'name'
+returning row_to_json(bucket.*)
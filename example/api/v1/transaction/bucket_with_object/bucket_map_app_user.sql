@@ -0,0 +1,3 @@
+-- the bucket_id field of the bucket step result
+insert into bucket_map_app_user
+values ($1::int, current_setting('app_user.id')::int)
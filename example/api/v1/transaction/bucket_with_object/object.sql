@@ -0,0 +1,3 @@
+insert into object(bucket_id, name)
+select $1::int, $2::json->>'object_name'
+returning row_to_json(object.*)
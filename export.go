@@ -0,0 +1,201 @@
+package servotron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var exportFilenamePattern = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// ExportHandler streams the CSV of the export SQL of the route through COPY
+// NOTE errors before the first byte are problems, later errors abort the response
+func (s *servotron) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	routeName := mux.CurrentRoute(r).GetName()
+	apiVersion, err := s.ResolveVersion(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	params, err := s.ExtractParams(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	log.Println("ExportHandler", "processing", r.Method, routeName, params)
+	tx, err := s.RequestTx(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+	ctx, cancel := s.DBContext(r)
+	defer cancel()
+	q, path, err := s.ReadSQL(apiVersion, "export", routeName+".sql")
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	params, err = s.CoerceParams(ctx, tx, string(q), s.ParamNames(r), params)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	pgConn := tx.Conn().PgConn()
+	copySQL, err := CopySQL(pgConn, string(q), params)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	log.Println("ExportHandler", "copying", path, params)
+	route, _ := RequestRoute(r)
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": ExportFilename(routeName)}))
+	sw := &streamWriter{
+		w:        w,
+		maxBytes: route.MaxBytes,
+		interval: time.Duration(s.config.StreamFlushInterval) * time.Millisecond,
+	}
+	_, err = pgConn.CopyTo(ctx, sw, copySQL)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		if 0 < sw.n {
+			s.AbortResponse(err)
+		}
+		w.Header().Del("Content-Disposition")
+		s.TeeError(w, err)
+		return
+	}
+	sw.Flush()
+}
+
+// ExportFilename returns the attachment filename of an export route
+func ExportFilename(routeName string) string {
+	return exportFilenamePattern.ReplaceAllString(routeName, "_") + ".csv"
+}
+
+// CopySQL wraps the export SQL in COPY TO STDOUT, with the params as literals
+// NOTE COPY does not take bind params
+func CopySQL(pgConn *pgconn.PgConn, q string, params []interface{}) (string, error) {
+	// NOTE quoted literals are only safe with standard conforming strings
+	if pgConn.ParameterStatus("standard_conforming_strings") != "on" {
+		return "", errors.New("export requires standard_conforming_strings")
+	}
+	q, err := TrimStatement(q)
+	if err != nil {
+		return "", err
+	}
+	q, err = InterpolateParams(q, params)
+	if err != nil {
+		return "", err
+	}
+	// NOTE the newline ends a trailing line comment
+	return fmt.Sprintf("copy (\n%s\n) to stdout with (format csv, header)", q), nil
+}
+
+// InterpolateParams replaces the $n placeholders of the SQL with quoted literals
+// NOTE quoted literals are untyped, so postgres infers their types as it does for bind params
+// NOTE comments, quoted strings, quoted identifiers and dollar quoted strings are skipped, as in CountPlaceholders
+func InterpolateParams(q string, params []interface{}) (string, error) {
+	var result strings.Builder
+	for i := 0; i < len(q); i++ {
+		end := 0
+		switch {
+		case strings.HasPrefix(q[i:], "--"):
+			end = strings.IndexByte(q[i:], '\n')
+		case strings.HasPrefix(q[i:], "/*"):
+			end = strings.Index(q[i+2:], "*/")
+			if 0 <= end {
+				end += 4
+			}
+		case q[i] == '\'' || q[i] == '"':
+			end = strings.IndexByte(q[i+1:], q[i])
+			if 0 <= end {
+				end += 2
+			}
+		case q[i] == '$':
+			if tag := dollarQuotePattern.FindString(q[i:]); tag != "" {
+				end = strings.Index(q[i+len(tag):], tag)
+				if 0 <= end {
+					end += 2 * len(tag)
+				}
+				break
+			}
+			j := i + 1
+			for j < len(q) && '0' <= q[j] && q[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(q[i+1 : j])
+			if err != nil {
+				break
+			}
+			if n < 1 || len(params) < n {
+				return "", fmt.Errorf("no param for placeholder %s", q[i:j])
+			}
+			literal, err := QuoteLiteral(params[n-1])
+			var paramErr *ParamError
+			if errors.As(err, &paramErr) {
+				paramErr.Name = q[i:j]
+			}
+			if err != nil {
+				return "", err
+			}
+			result.WriteString(literal)
+			i = j - 1
+			continue
+		}
+		if end < 0 {
+			end = len(q) - i
+		}
+		if end == 0 {
+			end = 1
+		}
+		result.WriteString(q[i : i+end])
+		i += end - 1
+	}
+	return result.String(), nil
+}
+
+// QuoteLiteral returns a param as a quoted SQL literal
+// NOTE array params are array literals
+func QuoteLiteral(param interface{}) (string, error) {
+	var text string
+	switch p := param.(type) {
+	case nil:
+		return "NULL", nil
+	case pgtype.Text:
+		if !p.Valid {
+			return "NULL", nil
+		}
+		text = p.String
+	case string:
+		text = p
+	case []string:
+		var elems []string
+		for _, e := range p {
+			elems = append(elems, `"`+strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(e)+`"`)
+		}
+		text = "{" + strings.Join(elems, ",") + "}"
+	case int64, float64, bool:
+		text = fmt.Sprint(p)
+	default:
+		return "", fmt.Errorf("unsupported param type %T", param)
+	}
+	if strings.ContainsRune(text, 0) {
+		return "", &ParamError{Type: "text", Value: text, Reason: "contains a null character"}
+	}
+	return "'" + strings.ReplaceAll(text, "'", "''") + "'", nil
+}
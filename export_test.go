@@ -0,0 +1,119 @@
+package servotron
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := []struct {
+		name   string
+		param  interface{}
+		result string
+		err    bool
+	}{
+		{"nil", nil, "NULL", false},
+		{"null text", pgtype.Text{}, "NULL", false},
+		{"text", pgtype.Text{String: "a", Valid: true}, "'a'", false},
+		{"string", "a", "'a'", false},
+		{"quote", "O'Brien", "'O''Brien'", false},
+		{"quotes", "''", "''''''", false},
+		{"injection", "'; drop table object; --", "'''; drop table object; --'", false},
+		{"backslash", `a\'b`, `'a\''b'`, false},
+		{"dollar", "$1 $$", "'$1 $$'", false},
+		{"int", int64(-5), "'-5'", false},
+		{"float", 1.5, "'1.5'", false},
+		{"bool", true, "'true'", false},
+		{"array", []string{"a", "b"}, "'{\"a\",\"b\"}'", false},
+		{"empty array", []string{}, "'{}'", false},
+		{"array quotes", []string{`a"b`, `c\d`, "e'f"}, `'{"a\"b","c\\d","e''f"}'`, false},
+		{"array separators", []string{"a,b", "{c}"}, `'{"a,b","{c}"}'`, false},
+		{"null character", "a\x00b", "", true},
+		{"array null character", []string{"a\x00"}, "", true},
+		{"unsupported", struct{}{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := QuoteLiteral(tt.param)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.result {
+				t.Errorf("expected %q, got %q", tt.result, result)
+			}
+		})
+	}
+}
+
+func TestInterpolateParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		q      string
+		params []interface{}
+		result string
+		err    bool
+	}{
+		{"placeholders", "select $1, $2", []interface{}{"a", int64(2)}, "select 'a', '2'", false},
+		{"repeated", "select $1 where $1 = x", []interface{}{"a"}, "select 'a' where 'a' = x", false},
+		{"cast", "select $1::int", []interface{}{"1"}, "select '1'::int", false},
+		{"adjacent", "select $1||$2", []interface{}{"a", "b"}, "select 'a'||'b'", false},
+		{"multiple digits", "select $10, $1", []interface{}{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}, "select '10', '1'", false},
+		{"quote", "select $1", []interface{}{"O'Brien"}, "select 'O''Brien'", false},
+		{"injection", "select * from object where name = $1", []interface{}{"x' or '1'='1"}, "select * from object where name = 'x'' or ''1''=''1'", false},
+		{"null", "select $1", []interface{}{nil}, "select NULL", false},
+		{"array", "select $1::text[]", []interface{}{[]string{"a", "b'c"}}, `select '{"a","b''c"}'::text[]`, false},
+		{"line comment", "select $1 -- $2\nwhere $1", []interface{}{"a"}, "select 'a' -- $2\nwhere 'a'", false},
+		{"trailing line comment", "select $1 -- $2", []interface{}{"a"}, "select 'a' -- $2", false},
+		{"block comment", "select /* $2 */ $1", []interface{}{"a"}, "select /* $2 */ 'a'", false},
+		{"unterminated block comment", "select $1 /* $2", []interface{}{"a"}, "select 'a' /* $2", false},
+		{"string", "select '$2', $1", []interface{}{"a"}, "select '$2', 'a'", false},
+		{"escaped quote", "select 'it''s $2', $1", []interface{}{"a"}, "select 'it''s $2', 'a'", false},
+		{"unterminated string", "select $1, '$2", []interface{}{"a"}, "select 'a', '$2", false},
+		{"quoted identifier", `select "$2", $1`, []interface{}{"a"}, `select "$2", 'a'`, false},
+		{"dollar quote", "select $$ $2 $$, $1", []interface{}{"a"}, "select $$ $2 $$, 'a'", false},
+		{"tagged dollar quote", "select $tag$ $2 $$ $tag$, $1", []interface{}{"a"}, "select $tag$ $2 $$ $tag$, 'a'", false},
+		{"unterminated dollar quote", "select $1, $$ $2", []interface{}{"a"}, "select 'a', $$ $2", false},
+		{"dollar without digits", "select $ + $1", []interface{}{"a"}, "select $ + 'a'", false},
+		{"zero placeholder", "select $0", []interface{}{"a"}, "", true},
+		{"missing param", "select $1, $2", []interface{}{"a"}, "", true},
+		{"no params", "select $1", nil, "", true},
+		{"null character", "select $1", []interface{}{"a\x00"}, "", true},
+		{"unsupported", "select $1", []interface{}{struct{}{}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := InterpolateParams(tt.q, tt.params)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != tt.result {
+				t.Errorf("expected %q, got %q", tt.result, result)
+			}
+		})
+	}
+}
+
+func TestInterpolateParamsParamError(t *testing.T) {
+	_, err := InterpolateParams("select $1, $2", []interface{}{"a", "b\x00"})
+	var paramErr *ParamError
+	if !errors.As(err, &paramErr) {
+		t.Fatalf("expected a ParamError, got %v", err)
+	}
+	if paramErr.Name != "$2" {
+		t.Errorf("expected the placeholder $2, got %q", paramErr.Name)
+	}
+}
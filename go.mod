@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/gorilla/mux v1.8.0
 	github.com/jackc/pgx/v5 v5.2.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
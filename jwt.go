@@ -0,0 +1,382 @@
+package servotron
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is wrapped by every JWT verification failure
+// NOTE requests failing verification are rejected with 401
+var ErrInvalidToken = errors.New("invalid token")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type jwtVerifier struct {
+	algorithms map[string]bool
+	secrets    [][]byte
+	keys       []crypto.PublicKey
+	issuer     string
+	audience   string
+	required   []string
+	leeway     time.Duration
+	jwksFile   string
+	mu         sync.RWMutex
+	jwks       map[string]interface{}
+}
+
+// NewJWTVerifier builds a verifier from the AppUserAuth config
+// NOTE list values (Secrets, PublicKeyFiles, Algorithms) are comma separated
+func NewJWTVerifier(cfg map[string]string) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		algorithms: make(map[string]bool),
+		issuer:     cfg["Issuer"],
+		audience:   cfg["Audience"],
+		required:   splitList(cfg["RequiredClaims"]),
+		jwksFile:   cfg["JWKSFile"],
+		jwks:       make(map[string]interface{}),
+	}
+	for _, alg := range splitList(cfg["Algorithms"]) {
+		switch alg {
+		case "HS256", "RS256", "ES256":
+			v.algorithms[alg] = true
+		default:
+			return v, fmt.Errorf("unsupported JWT algorithm %q", alg)
+		}
+	}
+	for _, secret := range splitList(cfg["Secrets"]) {
+		v.secrets = append(v.secrets, []byte(secret))
+	}
+	for _, f := range splitList(cfg["PublicKeyFiles"]) {
+		byt, err := os.ReadFile(f)
+		if err != nil {
+			return v, err
+		}
+		key, err := parsePEMPublicKey(byt)
+		if err != nil {
+			return v, fmt.Errorf("%s: %w", f, err)
+		}
+		v.keys = append(v.keys, key)
+	}
+	if cfg["Leeway"] != "" {
+		seconds, err := strconv.Atoi(cfg["Leeway"])
+		if err != nil {
+			return v, err
+		}
+		v.leeway = time.Duration(seconds) * time.Second
+	}
+	if v.jwksFile != "" {
+		err := v.LoadJWKS()
+		if err != nil {
+			return v, err
+		}
+		if cfg["JWKSRefreshInterval"] != "" {
+			seconds, err := strconv.Atoi(cfg["JWKSRefreshInterval"])
+			if err != nil {
+				return v, err
+			}
+			if 0 < seconds {
+				go v.RefreshJWKS(time.Duration(seconds) * time.Second)
+			}
+		}
+	}
+	if len(v.secrets) == 0 && len(v.keys) == 0 && v.jwksFile == "" {
+		return v, errors.New("JWT verification requires Secrets, PublicKeyFiles or JWKSFile")
+	}
+	return v, nil
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func parsePEMPublicKey(byt []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(byt)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+}
+
+// LoadJWKS reads the JWKS document from disk and swaps in its keys
+func (v *jwtVerifier) LoadJWKS() error {
+	byt, err := os.ReadFile(v.jwksFile)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(byt, &doc)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]interface{})
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.PublicKey()
+		if err != nil {
+			return fmt.Errorf("%s: key %d: %w", v.jwksFile, i, err)
+		}
+		kid := k.Kid
+		if kid == "" {
+			kid = strconv.Itoa(i)
+		}
+		keys[kid] = key
+	}
+	v.mu.Lock()
+	v.jwks = keys
+	v.mu.Unlock()
+	return nil
+}
+
+// RefreshJWKS reloads the JWKS document on the given interval
+// NOTE a failed reload keeps the previously loaded keys
+func (v *jwtVerifier) RefreshJWKS(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := v.LoadJWKS()
+		if err != nil {
+			log.Println("RefreshJWKS", err)
+		}
+	}
+}
+
+func (k jwk) PublicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// Verify checks the signature and registered claims of a compact JWT
+// and returns the decoded payload
+func (v *jwtVerifier) Verify(token string) ([]byte, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf(
+			"%w: expected 3 segments, found %d",
+			ErrInvalidToken,
+			len(segments))
+	}
+	byt, err := base64.RawURLEncoding.DecodeString(segments[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %s", ErrInvalidToken, err)
+	}
+	var header jwtHeader
+	err = json.Unmarshal(byt, &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %s", ErrInvalidToken, err)
+	}
+	if !v.algorithms[header.Alg] {
+		return nil, fmt.Errorf("%w: algorithm %q not allowed", ErrInvalidToken, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %s", ErrInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	verified := false
+	for _, key := range v.Candidates(header) {
+		if v.VerifySignature(header.Alg, key, segments[0]+"."+segments[1], digest[:], sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature verification failed", ErrInvalidToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload: %s", ErrInvalidToken, err)
+	}
+	err = v.VerifyClaims(payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Candidates returns the keys to try for the token
+// NOTE a kid found in the JWKS narrows the candidates to that key
+func (v *jwtVerifier) Candidates(header jwtHeader) []interface{} {
+	var result []interface{}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if key, ok := v.jwks[header.Kid]; ok && header.Kid != "" {
+		return append(result, key)
+	}
+	for _, secret := range v.secrets {
+		result = append(result, secret)
+	}
+	for _, key := range v.keys {
+		result = append(result, key)
+	}
+	for _, key := range v.jwks {
+		result = append(result, key)
+	}
+	return result
+}
+
+func (v *jwtVerifier) VerifySignature(alg string, key interface{}, signingInput string, digest []byte, sig []byte) bool {
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		return hmac.Equal(sig, mac.Sum(nil))
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+func (v *jwtVerifier) VerifyClaims(payload []byte) error {
+	var claims map[string]interface{}
+	err := json.Unmarshal(payload, &claims)
+	if err != nil {
+		return fmt.Errorf("%w: payload: %s", ErrInvalidToken, err)
+	}
+	// NOTE registered claims are only checked if present, unless required
+	for _, name := range v.required {
+		if _, present := claims[name]; !present {
+			return fmt.Errorf("%w: missing %s claim", ErrInvalidToken, name)
+		}
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+			return fmt.Errorf("%w: token expired", ErrInvalidToken)
+		}
+	} else if _, present := claims["exp"]; present {
+		return fmt.Errorf("%w: invalid exp claim", ErrInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+			return fmt.Errorf("%w: token not yet valid", ErrInvalidToken)
+		}
+	} else if _, present := claims["nbf"]; present {
+		return fmt.Errorf("%w: invalid nbf claim", ErrInvalidToken)
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	if v.audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == v.audience
+		case []interface{}:
+			for _, a := range aud {
+				if a == v.audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package servotron
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSecret    = []byte("secret")
+	testRSAKey    = mustRSAKey()
+	testOtherRSA  = mustRSAKey()
+	testECKey     = mustECKey()
+	testOtherEC   = mustECKey()
+	testNotBefore = time.Now().Add(-time.Minute).Unix()
+)
+
+func mustRSAKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func mustECKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// signJWT returns a compact JWT of the claims signed with the key
+func signJWT(t *testing.T, header map[string]string, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case nil:
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writePEM(t *testing.T, dir string, name string, key crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(dir, name)
+	err = os.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func writeJWKS(t *testing.T, dir string) string {
+	t.Helper()
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	testECKey.X.FillBytes(x)
+	testECKey.Y.FillBytes(y)
+	doc := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(testRSAKey.N.Bytes()), "e": encode(big.NewInt(int64(testRSAKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(x), "y": encode(y)},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": encode(testOtherRSA.N.Bytes()), "e": encode(big.NewInt(int64(testOtherRSA.E)).Bytes())},
+		},
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(dir, "jwks.json")
+	err = os.WriteFile(f, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "user_a",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"nbf": testNotBefore,
+	}
+}
+
+func TestJWTVerifierSignatures(t *testing.T) {
+	dir := t.TempDir()
+	rsaFile := writePEM(t, dir, "rsa.pem", &testRSAKey.PublicKey)
+	ecFile := writePEM(t, dir, "ec.pem", &testECKey.PublicKey)
+	hs256 := map[string]string{"alg": "HS256", "typ": "JWT"}
+	rs256 := map[string]string{"alg": "RS256", "typ": "JWT"}
+	es256 := map[string]string{"alg": "ES256", "typ": "JWT"}
+	tests := []struct {
+		name  string
+		cfg   map[string]string
+		token string
+		valid bool
+	}{
+		{"HS256", map[string]string{"Algorithms": "HS256", "Secrets": "secret"},
+			signJWT(t, hs256, validClaims(), testSecret), true},
+		{"HS256 rotated secret", map[string]string{"Algorithms": "HS256", "Secrets": "old, secret"},
+			signJWT(t, hs256, validClaims(), testSecret), true},
+		{"HS256 wrong secret", map[string]string{"Algorithms": "HS256", "Secrets": "secret"},
+			signJWT(t, hs256, validClaims(), []byte("other")), false},
+		{"RS256", map[string]string{"Algorithms": "RS256", "PublicKeyFiles": rsaFile},
+			signJWT(t, rs256, validClaims(), testRSAKey), true},
+		{"RS256 wrong key", map[string]string{"Algorithms": "RS256", "PublicKeyFiles": rsaFile},
+			signJWT(t, rs256, validClaims(), testOtherRSA), false},
+		{"ES256", map[string]string{"Algorithms": "ES256", "PublicKeyFiles": ecFile},
+			signJWT(t, es256, validClaims(), testECKey), true},
+		{"ES256 wrong key", map[string]string{"Algorithms": "ES256", "PublicKeyFiles": ecFile},
+			signJWT(t, es256, validClaims(), testOtherEC), false},
+		{"algorithm not allowed", map[string]string{"Algorithms": "RS256", "Secrets": "secret", "PublicKeyFiles": rsaFile},
+			signJWT(t, hs256, validClaims(), testSecret), false},
+		{"none", map[string]string{"Algorithms": "HS256", "Secrets": "secret"},
+			signJWT(t, map[string]string{"alg": "none"}, validClaims(), nil), false},
+		{"HS256 signed with the RSA public key", map[string]string{"Algorithms": "HS256,RS256", "PublicKeyFiles": rsaFile},
+			signJWT(t, hs256, validClaims(), x509.MarshalPKCS1PublicKey(&testRSAKey.PublicKey)), false},
+		{"HS256 signed with the RSA public key PEM", map[string]string{"Algorithms": "HS256,RS256", "PublicKeyFiles": rsaFile},
+			signJWT(t, hs256, validClaims(), mustReadFile(t, rsaFile)), false},
+		{"RS256 token for an EC key", map[string]string{"Algorithms": "RS256,ES256", "PublicKeyFiles": ecFile},
+			signJWT(t, rs256, validClaims(), testRSAKey), false},
+		{"ES256 token for an RSA key", map[string]string{"Algorithms": "RS256,ES256", "PublicKeyFiles": rsaFile},
+			signJWT(t, es256, validClaims(), testECKey), false},
+		{"ES256 header on an RS256 signature", map[string]string{"Algorithms": "RS256,ES256", "PublicKeyFiles": rsaFile + "," + ecFile},
+			signJWT(t, es256, validClaims(), testRSAKey), false},
+		{"two segments", map[string]string{"Algorithms": "HS256", "Secrets": "secret"},
+			"e30.e30", false},
+		{"empty", map[string]string{"Algorithms": "HS256", "Secrets": "secret"},
+			"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewJWTVerifier(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = v.Verify(tt.token)
+			if tt.valid && err != nil {
+				t.Fatalf("expected a valid token, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected ErrInvalidToken, got %v", err)
+			}
+		})
+	}
+}
+
+func mustReadFile(t *testing.T, f string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestJWTVerifierTamperedPayload(t *testing.T) {
+	v, err := NewJWTVerifier(map[string]string{"Algorithms": "HS256", "Secrets": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signJWT(t, map[string]string{"alg": "HS256"}, validClaims(), testSecret)
+	forged := signJWT(t, map[string]string{"alg": "HS256"}, map[string]interface{}{"sub": "admin"}, testSecret)
+	segments := strings.Split(token, ".")
+	segments[1] = strings.Split(forged, ".")[1]
+	_, err = v.Verify(strings.Join(segments, "."))
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestJWTVerifierJWKS(t *testing.T) {
+	jwksFile := writeJWKS(t, t.TempDir())
+	v, err := NewJWTVerifier(map[string]string{"Algorithms": "RS256,ES256", "JWKSFile": jwksFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256 kid", signJWT(t, map[string]string{"alg": "RS256", "kid": "rsa"}, validClaims(), testRSAKey), true},
+		{"ES256 kid", signJWT(t, map[string]string{"alg": "ES256", "kid": "ec"}, validClaims(), testECKey), true},
+		{"no kid", signJWT(t, map[string]string{"alg": "RS256"}, validClaims(), testRSAKey), true},
+		{"kid of another key", signJWT(t, map[string]string{"alg": "RS256", "kid": "ec"}, validClaims(), testRSAKey), false},
+		{"kid missing from the JWKS", signJWT(t, map[string]string{"alg": "RS256", "kid": "missing"}, validClaims(), testOtherRSA), false},
+		{"encryption key", signJWT(t, map[string]string{"alg": "RS256", "kid": "enc"}, validClaims(), testOtherRSA), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.Verify(tt.token)
+			if tt.valid && err != nil {
+				t.Fatalf("expected a valid token, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected ErrInvalidToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierClaims(t *testing.T) {
+	now := time.Now()
+	with := func(k string, v interface{}) map[string]interface{} {
+		claims := validClaims()
+		claims[k] = v
+		return claims
+	}
+	without := func(k string) map[string]interface{} {
+		claims := validClaims()
+		delete(claims, k)
+		return claims
+	}
+	tests := []struct {
+		name   string
+		cfg    map[string]string
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{"valid", nil, validClaims(), true},
+		{"expired", nil, with("exp", now.Add(-time.Minute).Unix()), false},
+		{"expired within leeway", map[string]string{"Leeway": "120"}, with("exp", now.Add(-time.Minute).Unix()), true},
+		{"expired beyond leeway", map[string]string{"Leeway": "30"}, with("exp", now.Add(-time.Minute).Unix()), false},
+		{"invalid exp", nil, with("exp", "tomorrow"), false},
+		{"missing exp", nil, without("exp"), false},
+		{"missing exp not required", map[string]string{"RequiredClaims": ""}, without("exp"), true},
+		{"not yet valid", nil, with("nbf", now.Add(time.Minute).Unix()), false},
+		{"not yet valid within leeway", map[string]string{"Leeway": "120"}, with("nbf", now.Add(time.Minute).Unix()), true},
+		{"invalid nbf", nil, with("nbf", "now"), false},
+		{"missing required nbf", map[string]string{"RequiredClaims": "exp,nbf"}, without("nbf"), false},
+		{"issuer", map[string]string{"Issuer": "https://issuer"}, with("iss", "https://issuer"), true},
+		{"wrong issuer", map[string]string{"Issuer": "https://issuer"}, with("iss", "https://other"), false},
+		{"missing issuer", map[string]string{"Issuer": "https://issuer"}, validClaims(), false},
+		{"audience", map[string]string{"Audience": "api"}, with("aud", "api"), true},
+		{"audience list", map[string]string{"Audience": "api"}, with("aud", []string{"web", "api"}), true},
+		{"wrong audience", map[string]string{"Audience": "api"}, with("aud", "web"), false},
+		{"wrong audience list", map[string]string{"Audience": "api"}, with("aud", []string{"web"}), false},
+		{"missing audience", map[string]string{"Audience": "api"}, validClaims(), false},
+		{"missing required aud", map[string]string{"RequiredClaims": "exp,aud"}, validClaims(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := map[string]string{"Algorithms": "HS256", "Secrets": "secret", "RequiredClaims": "exp"}
+			for k, v := range tt.cfg {
+				cfg[k] = v
+			}
+			v, err := NewJWTVerifier(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, err := v.Verify(signJWT(t, map[string]string{"alg": "HS256"}, tt.claims, testSecret))
+			if tt.valid && err != nil {
+				t.Fatalf("expected a valid token, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected ErrInvalidToken, got %v", err)
+			}
+			if tt.valid {
+				sub, _, err := JWTClaim(payload, "sub")
+				if err != nil || sub != "user_a" {
+					t.Fatalf("expected the payload, got %s", payload)
+				}
+			}
+		})
+	}
+}
+
+func TestNewJWTVerifier(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+	}{
+		{"no keys", map[string]string{"Algorithms": "HS256"}},
+		{"unsupported algorithm", map[string]string{"Algorithms": "HS512", "Secrets": "secret"}},
+		{"none algorithm", map[string]string{"Algorithms": "none", "Secrets": "secret"}},
+		{"missing key file", map[string]string{"Algorithms": "RS256", "PublicKeyFiles": filepath.Join(t.TempDir(), "missing.pem")}},
+		{"invalid leeway", map[string]string{"Algorithms": "HS256", "Secrets": "secret", "Leeway": "1m"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewJWTVerifier(tt.cfg)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,592 @@
+package servotron
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"gopkg.in/yaml.v3"
+)
+
+var openAPIMethods = []string{"get", "post", "put", "delete", "patch"}
+
+var openAPIRouteTypes = map[string]string{
+	"get":    "read",
+	"post":   "create",
+	"put":    "update",
+	"delete": "delete",
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+	} `json:"components"`
+	XServotron struct {
+		BasePath string
+	} `json:"x-servotron"`
+}
+
+type openAPIOperation struct {
+	OperationID string             `json:"operationId"`
+	Summary     string             `json:"summary"`
+	Description string             `json:"description"`
+	Parameters  []openAPIParameter `json:"parameters"`
+	// NOTE the extension holds any Route field, so route options need no mapping of their own
+	XServotron struct {
+		Route
+		Ignore bool
+	} `json:"x-servotron"`
+}
+
+type openAPIParameter struct {
+	Ref      string         `json:"$ref,omitempty"`
+	Name     string         `json:"name,omitempty"`
+	In       string         `json:"in,omitempty"`
+	Required bool           `json:"required,omitempty"`
+	Schema   *openAPISchema `json:"schema,omitempty"`
+}
+
+type openAPISchema struct {
+	Type      string         `json:"type,omitempty"`
+	Format    string         `json:"format,omitempty"`
+	Pattern   string         `json:"pattern,omitempty"`
+	Minimum   *float64       `json:"minimum,omitempty"`
+	Maximum   *float64       `json:"maximum,omitempty"`
+	MinLength *float64       `json:"minLength,omitempty"`
+	MaxLength *float64       `json:"maxLength,omitempty"`
+	Enum      []interface{}  `json:"enum,omitempty"`
+	Default   interface{}    `json:"default,omitempty"`
+	Items     *openAPISchema `json:"items,omitempty"`
+}
+
+// GetRoutesFromOpenAPI maps the operations of an OpenAPI 3 YAML or JSON document onto routes
+// NOTE operationIds are route names and HTTP methods are route types
+// NOTE the x-servotron extension of an operation can set any Route field but URLScheme, or Ignore it
+// NOTE the x-servotron extension of the document can set a BasePath prefixed to every path
+func (s *servotron) GetRoutesFromOpenAPI(b []byte) ([]Route, error) {
+	var result []Route
+	var doc openAPIDocument
+	err := UnmarshalYAML(b, &doc)
+	if err != nil {
+		return result, err
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return result, fmt.Errorf("unsupported OpenAPI version %q", doc.OpenAPI)
+	}
+	var paths []string
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	seen := make(map[string]int)
+	for _, p := range paths {
+		item := doc.Paths[p]
+		var shared []openAPIParameter
+		if raw, ok := item["parameters"]; ok {
+			err = json.Unmarshal(raw, &shared)
+			if err != nil {
+				return result, fmt.Errorf("%s: %w", p, err)
+			}
+		}
+		for _, method := range openAPIMethods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			var op openAPIOperation
+			err = json.Unmarshal(raw, &op)
+			if err != nil {
+				return result, fmt.Errorf("%s %s: %w", method, p, err)
+			}
+			if op.XServotron.Ignore {
+				continue
+			}
+			route, err := doc.Route(doc.XServotron.BasePath+p, method, op, shared)
+			if err != nil {
+				return result, fmt.Errorf("%s %s: %w", method, p, err)
+			}
+			// NOTE transaction routes serve the methods of their operations, unless the extension sets Methods
+			inferMethods := route.Type == "transaction" && len(op.XServotron.Methods) == 0
+			if inferMethods {
+				route.Methods = []string{strings.ToUpper(method)}
+			}
+			// NOTE service and transaction routes serve every method of a path
+			if i, ok := seen[route.Type+" "+route.Name]; ok {
+				if inferMethods {
+					result[i].Methods = append(result[i].Methods, strings.ToUpper(method))
+				}
+				continue
+			}
+			seen[route.Type+" "+route.Name] = len(result)
+			result = append(result, route)
+		}
+	}
+	return result, nil
+}
+
+func (doc *openAPIDocument) Route(urlScheme string, method string, op openAPIOperation, shared []openAPIParameter) (Route, error) {
+	// NOTE the path is the URLScheme, and the operation fills the fields the extension leaves empty
+	route := op.XServotron.Route
+	route.URLScheme = urlScheme
+	if route.Name == "" {
+		route.Name = op.OperationID
+	}
+	if route.Type == "" {
+		route.Type = openAPIRouteTypes[method]
+	}
+	if route.Description == "" {
+		route.Description = op.Summary
+	}
+	if route.Description == "" {
+		route.Description = op.Description
+	}
+	if route.Name == "" {
+		return route, fmt.Errorf("missing operationId")
+	}
+	if route.Type == "" {
+		return route, fmt.Errorf("no route type for method, set x-servotron Type")
+	}
+	// NOTE operation parameters override path item parameters of the same name and location
+	params := make(map[string]openAPIParameter)
+	var order []string
+	all := append(append([]openAPIParameter{}, shared...), op.Parameters...)
+	for _, param := range all {
+		param, err := doc.Parameter(param)
+		if err != nil {
+			return route, err
+		}
+		key := param.In + " " + param.Name
+		if _, ok := params[key]; !ok {
+			order = append(order, key)
+		}
+		params[key] = param
+	}
+	// NOTE extension QueryParams are for specs without a JSON Schema mapping, such as the flat list of routes JSON,
+	// and replace the query parameters, so both cannot be set
+	if 0 < len(route.QueryParams) {
+		for _, key := range order {
+			if params[key].In == "query" {
+				return route, fmt.Errorf("x-servotron QueryParams and query parameters are both set")
+			}
+		}
+		return route, nil
+	}
+	for _, key := range order {
+		param := params[key]
+		if param.In != "query" {
+			continue
+		}
+		queryParam, err := param.QueryParam()
+		if err != nil {
+			return route, err
+		}
+		route.QueryParams = append(route.QueryParams, queryParam)
+	}
+	return route, nil
+}
+
+// Parameter resolves a parameter reference to the components of the document
+func (doc *openAPIDocument) Parameter(param openAPIParameter) (openAPIParameter, error) {
+	if param.Ref == "" {
+		return param, nil
+	}
+	name := strings.TrimPrefix(param.Ref, "#/components/parameters/")
+	result, ok := doc.Components.Parameters[name]
+	if !ok || name == param.Ref {
+		return param, fmt.Errorf("unresolved parameter reference %q", param.Ref)
+	}
+	return result, nil
+}
+
+// QueryParam maps a query parameter schema onto a query param spec
+func (param openAPIParameter) QueryParam() (QueryParam, error) {
+	var schema openAPISchema
+	if param.Schema != nil {
+		schema = *param.Schema
+	}
+	result := QueryParam{
+		Name:     param.Name,
+		Required: param.Required,
+		Pattern:  schema.Pattern,
+	}
+	if schema.Type == "array" && schema.Items != nil {
+		result.Array = true
+		schema = *schema.Items
+		if result.Pattern == "" {
+			result.Pattern = schema.Pattern
+		}
+	}
+	switch {
+	case schema.Type == "integer", schema.Type == "number", schema.Type == "boolean":
+		result.Type = schema.Type
+		result.Min = schema.Minimum
+		result.Max = schema.Maximum
+	case schema.Format == "uuid", schema.Format == "date":
+		result.Type = schema.Format
+	default:
+		result.Type = "string"
+		result.Min = schema.MinLength
+		result.Max = schema.MaxLength
+	}
+	for _, e := range schema.Enum {
+		result.Enum = append(result.Enum, fmt.Sprint(e))
+	}
+	if param.Schema != nil && param.Schema.Default != nil {
+		result.Default = fmt.Sprint(param.Schema.Default)
+		result.hasDefault = true
+	}
+	return result, result.Compile()
+}
+
+// routeTypeMethods are the HTTP methods documented for each route type
+var routeTypeMethods = map[string][]string{
+	"read":        {"get"},
+	"export":      {"get"},
+	"create":      {"post"},
+	"update":      {"put"},
+	"delete":      {"delete"},
+	"transaction": {"post", "put", "delete"},
+	"service":     {"get", "post", "put", "delete", "patch"},
+}
+
+var operationIDPattern = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+type openAPISpec struct {
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Paths      map[string]map[string]openAPISpecOperation `json:"paths"`
+	Components map[string]interface{}                     `json:"components"`
+	Security   []map[string][]string                      `json:"security,omitempty"`
+}
+
+type openAPISpecOperation struct {
+	OperationID string                 `json:"operationId"`
+	Summary     string                 `json:"summary,omitempty"`
+	Deprecated  bool                   `json:"deprecated,omitempty"`
+	Parameters  []openAPIParameter     `json:"parameters,omitempty"`
+	RequestBody map[string]interface{} `json:"requestBody,omitempty"`
+	Responses   map[string]interface{} `json:"responses"`
+	XServotron  map[string]string      `json:"x-servotron"`
+}
+
+// OpenAPIHandler writes the OpenAPI 3 document of the loaded routes for the requested version
+func (s *servotron) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	apiVersion, err := s.ResolveVersion(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	spec, err := s.OpenAPISpec(apiVersion, s.config.Routes)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	j, err := json.Marshal(spec)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	w.Write(j)
+}
+
+// OpenAPISpec builds an OpenAPI 3 document of the routes
+// NOTE request and response schemas are read from JSON Schema files next to the SQL, see OpenAPISchema
+// NOTE the x-servotron extension of each operation holds the route Name and Type, so the document can be imported
+func (s *servotron) OpenAPISpec(apiVersion string, routes []Route) (openAPISpec, error) {
+	var result openAPISpec
+	result.OpenAPI = "3.0.3"
+	result.Info.Title = "servotron"
+	result.Info.Version = apiVersion
+	result.Paths = make(map[string]map[string]openAPISpecOperation)
+	result.Components = map[string]interface{}{
+		"schemas": map[string]interface{}{
+			"Problem": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"type":       map[string]string{"type": "string"},
+					"title":      map[string]string{"type": "string"},
+					"status":     map[string]string{"type": "integer"},
+					"code":       map[string]string{"type": "string"},
+					"detail":     map[string]string{"type": "string"},
+					"hint":       map[string]string{"type": "string"},
+					"constraint": map[string]string{"type": "string"},
+				},
+			},
+		},
+		"parameters": map[string]openAPIParameter{
+			"Version": {
+				Name:     "Version",
+				In:       "header",
+				Required: s.config.DefaultVersion == "",
+				Schema:   &openAPISchema{Type: "string", Enum: []interface{}{apiVersion}},
+			},
+		},
+	}
+	if scheme := s.OpenAPISecurityScheme(); scheme != nil {
+		result.Components["securitySchemes"] = map[string]interface{}{"appUser": scheme}
+		result.Security = []map[string][]string{{"appUser": {}}}
+	}
+	for _, r := range routes {
+		path, params := OpenAPIPath(r.URLScheme)
+		if r.Type == "read" || r.Type == "export" {
+			for _, p := range r.QueryParams {
+				params = append(params, p.OpenAPIParameter())
+			}
+		}
+		params = append(params, openAPIParameter{Ref: "#/components/parameters/Version"})
+		methods := routeTypeMethods[r.Type]
+		if r.Type == "transaction" {
+			methods = nil
+			for _, method := range r.TransactionMethods() {
+				methods = append(methods, strings.ToLower(method))
+			}
+		}
+		for _, method := range methods {
+			op := openAPISpecOperation{
+				OperationID: operationIDPattern.ReplaceAllString(r.Type+"_"+r.Name, "_"),
+				Summary:     r.Description,
+				Deprecated:  s.config.Versions[apiVersion].Deprecated,
+				Parameters:  params,
+				XServotron:  map[string]string{"Name": r.Name, "Type": r.Type},
+			}
+			if 1 < len(methods) {
+				op.OperationID += "_" + method
+			}
+			err := s.OpenAPIOperation(apiVersion, r, method, &op)
+			if err != nil {
+				return result, fmt.Errorf("route %s: %w", r.Name, err)
+			}
+			if result.Paths[path] == nil {
+				result.Paths[path] = make(map[string]openAPISpecOperation)
+			}
+			result.Paths[path][method] = op
+		}
+	}
+	return result, nil
+}
+
+// OpenAPIOperation sets the request body and responses of the operation by route type
+func (s *servotron) OpenAPIOperation(apiVersion string, r Route, method string, op *openAPISpecOperation) error {
+	problem := map[string]interface{}{
+		"description": "problem details",
+		"content": map[string]interface{}{
+			"application/problem+json": map[string]interface{}{
+				"schema": map[string]string{"$ref": "#/components/schemas/Problem"},
+			},
+		},
+	}
+	op.Responses = map[string]interface{}{"default": problem}
+	var requestSchema, responseSchema json.RawMessage
+	var err error
+	switch r.Type {
+	case "read", "create", "update":
+		// NOTE create and update respond with the selected resources
+		responseSchema, err = s.OpenAPISchema(apiVersion, "select", r.Name+".schema.json")
+		if err != nil {
+			return err
+		}
+		if r.Type != "read" {
+			responseSchema = json.RawMessage(fmt.Sprintf(`{"type":"array","items":%s}`, responseSchema))
+			crudDir := "insert"
+			if r.Type == "update" {
+				crudDir = "update"
+			}
+			requestSchema, err = s.OpenAPISchema(apiVersion, crudDir, r.Name+".schema.json")
+		}
+	case "transaction":
+		requestSchema, err = s.OpenAPISchema(apiVersion, "transaction", r.Name, "request.schema.json")
+		if err != nil {
+			return err
+		}
+		responseSchema, err = s.OpenAPISchema(apiVersion, "transaction", r.Name, "response.schema.json")
+	}
+	if err != nil {
+		return err
+	}
+	if requestSchema != nil {
+		op.RequestBody = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": requestSchema},
+			},
+		}
+	}
+	response := map[string]interface{}{
+		"description": op.Summary,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": responseSchema},
+		},
+	}
+	if op.Summary == "" {
+		response["description"] = r.Name
+	}
+	if r.Type == "export" {
+		response["content"] = map[string]interface{}{
+			"text/csv": map[string]interface{}{"schema": map[string]string{"type": "string"}},
+		}
+	}
+	switch {
+	case r.Type == "service":
+		op.Responses["default"] = map[string]interface{}{"description": "proxied to the service"}
+	case r.Type == "delete":
+		op.Responses["204"] = map[string]interface{}{"description": "deleted"}
+		op.Responses["404"] = problem
+	case method == "post":
+		op.Responses["201"] = response
+	default:
+		op.Responses["200"] = response
+	}
+	if r.Type == "update" {
+		op.Responses["404"] = problem
+	}
+	return nil
+}
+
+// OpenAPISchema reads a JSON Schema file from the version dir
+// NOTE a missing file is the empty schema, which allows any value
+func (s *servotron) OpenAPISchema(apiVersion string, elem ...string) (json.RawMessage, error) {
+	b, path, err := s.ReadSQL(apiVersion, elem...)
+	if errors.Is(err, fs.ErrNotExist) {
+		return json.RawMessage("{}"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("invalid JSON Schema %s", path)
+	}
+	return json.RawMessage(b), nil
+}
+
+// OpenAPISecurityScheme describes how the app user auth is sent
+// NOTE returns nil for cookie auth without a cookie Name
+func (s *servotron) OpenAPISecurityScheme() map[string]string {
+	auth := s.config.AppUserAuth
+	switch {
+	case auth["ParseFrom"] == "Header" && auth["Type"] == "JWT" && strings.EqualFold(auth["Field"], "Authorization"):
+		return map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+	case auth["ParseFrom"] == "Header":
+		return map[string]string{"type": "apiKey", "in": "header", "name": auth["Field"]}
+	case auth["ParseFrom"] == "Cookie" && auth["Name"] != "":
+		return map[string]string{"type": "apiKey", "in": "cookie", "name": auth["Name"]}
+	}
+	return nil
+}
+
+// OpenAPIPath converts a URL scheme to an OpenAPI path and its path parameters
+// NOTE mux patterns such as {id:[0-9]+} become the pattern of the parameter
+func OpenAPIPath(urlScheme string) (string, []openAPIParameter) {
+	var params []openAPIParameter
+	path := pathVarPattern.ReplaceAllStringFunc(urlScheme, func(v string) string {
+		split := strings.SplitN(v[1:len(v)-1], ":", 2)
+		param := openAPIParameter{
+			Name:     split[0],
+			In:       "path",
+			Required: true,
+			Schema:   &openAPISchema{Type: "string"},
+		}
+		if len(split) == 2 {
+			param.Schema.Pattern = "^" + split[1] + "$"
+		}
+		params = append(params, param)
+		return "{" + split[0] + "}"
+	})
+	return path, params
+}
+
+// OpenAPIParameter maps a query param spec onto a query parameter schema
+func (p QueryParam) OpenAPIParameter() openAPIParameter {
+	schema := &openAPISchema{Type: p.Type, Pattern: p.Pattern}
+	switch p.Type {
+	case "integer", "number":
+		schema.Minimum = p.Min
+		schema.Maximum = p.Max
+	case "boolean":
+	case "uuid", "date":
+		schema.Type = "string"
+		schema.Format = p.Type
+	default:
+		schema.MinLength = p.Min
+		schema.MaxLength = p.Max
+	}
+	for _, e := range p.Enum {
+		schema.Enum = append(schema.Enum, OpenAPIValue(p.Type, e))
+	}
+	if p.hasDefault {
+		schema.Default = OpenAPIValue(p.Type, p.Default)
+	}
+	if p.Array {
+		schema = &openAPISchema{Type: "array", Items: schema}
+	}
+	return openAPIParameter{
+		Name:     p.Name,
+		In:       "query",
+		Required: p.Required,
+		Schema:   schema,
+	}
+}
+
+// OpenAPIValue converts a query param value to the JSON type of the param
+func OpenAPIValue(paramType string, value string) interface{} {
+	switch paramType {
+	case "integer", "number":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, _, ok := CoerceParam(pgtype.BoolOID, value); ok {
+			return b
+		}
+	}
+	return value
+}
+
+// StringKeys converts YAML maps with non string keys, such as response codes, to JSON objects
+func StringKeys(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			result[fmt.Sprint(k)] = StringKeys(val)
+		}
+		return result
+	case map[string]interface{}:
+		for k, val := range t {
+			t[k] = StringKeys(val)
+		}
+		return t
+	case []interface{}:
+		for i, val := range t {
+			t[i] = StringKeys(val)
+		}
+		return t
+	}
+	return v
+}
+
+// UnmarshalYAML decodes a YAML or JSON document into v via its JSON struct tags
+func UnmarshalYAML(b []byte, v interface{}) error {
+	var doc interface{}
+	err := yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(StringKeys(doc))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
@@ -0,0 +1,233 @@
+package servotron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrDatabaseUnavailable is returned for requests to a database that has not been reached since startup
+var ErrDatabaseUnavailable = errors.New("database unavailable")
+
+// maxReconnectBackoff caps the delay between startup connection attempts
+const maxReconnectBackoff = 30 * time.Second
+
+// readerPools round robins over the healthy reader pools
+type readerPools struct {
+	pools   []*pgxpool.Pool
+	healthy []atomic.Bool
+	next    atomic.Uint32
+}
+
+func NewReaderPools(pools []*pgxpool.Pool) *readerPools {
+	result := &readerPools{
+		pools:   pools,
+		healthy: make([]atomic.Bool, len(pools)),
+	}
+	for i := range result.healthy {
+		result.healthy[i].Store(true)
+	}
+	return result
+}
+
+// Next returns the next healthy reader pool
+// NOTE returns nil if there are no healthy readers
+func (p *readerPools) Next() *pgxpool.Pool {
+	if p == nil {
+		return nil
+	}
+	n := uint32(len(p.pools))
+	for i := uint32(0); i < n; i++ {
+		j := p.next.Add(1) % n
+		if p.healthy[j].Load() {
+			return p.pools[j]
+		}
+	}
+	return nil
+}
+
+// Check pings each reader pool and marks it healthy or not
+func (p *readerPools) Check(timeout time.Duration) {
+	for i, pool := range p.pools {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := pool.Ping(ctx)
+		cancel()
+		healthy := err == nil
+		if p.healthy[i].Swap(healthy) != healthy {
+			log.Println("readerPools", "reader", i, "healthy:", healthy, err)
+		}
+	}
+}
+
+// Watch checks the reader pools every interval
+func (p *readerPools) Watch(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.Check(timeout)
+	}
+}
+
+// NOTE if database json changes, then the database struct must change
+type Database struct {
+	ConnString        string
+	ReaderConnStrings []string
+}
+
+// database holds the writer pool and the reader pools of a database
+// NOTE available is set once the writer has been reached
+type database struct {
+	pool      *pgxpool.Pool
+	readers   *readerPools
+	available atomic.Bool
+}
+
+// NewDatabase creates the pools of a database and watches the health of its readers
+func (s *servotron) NewDatabase(cfg Database) (*database, error) {
+	result := &database{}
+	pool, err := s.NewPool(cfg.ConnString)
+	if err != nil {
+		return result, err
+	}
+	result.pool = pool
+	if 0 < len(cfg.ReaderConnStrings) {
+		var readers []*pgxpool.Pool
+		for _, connString := range cfg.ReaderConnStrings {
+			reader, err := s.NewPool(connString)
+			if err != nil {
+				return result, err
+			}
+			readers = append(readers, reader)
+		}
+		result.readers = NewReaderPools(readers)
+		interval := time.Duration(s.config.DBHealthCheckInterval) * time.Second
+		timeout := time.Duration(s.config.DBQueryTimeout) * time.Second
+		go result.readers.Watch(interval, timeout)
+	}
+	return result, nil
+}
+
+// Connect pings the writer until it is reached, backing off between attempts
+// NOTE the server starts degraded, requests to the database fail fast with 503 until it is reached
+func (db *database) Connect(name string, timeout time.Duration) {
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := db.pool.Ping(ctx)
+		cancel()
+		if err == nil {
+			db.available.Store(true)
+			log.Println("Connect", "connected to database", name)
+			return
+		}
+		log.Println("Connect", "database", name, "unavailable, retrying in", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if maxReconnectBackoff < backoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// NewPool creates a pool for the connection string with the configured pool limits
+// NOTE the DBAfterConnect SQL runs on every new connection, for search_path, settings and prepared statements
+func (s *servotron) NewPool(connString string) (*pgxpool.Pool, error) {
+	pgxpoolConfig, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	pgxpoolConfig.MinConns = int32(s.config.DBPoolMinConns)
+	pgxpoolConfig.MaxConns = int32(s.config.DBPoolMaxConns)
+	if 0 < s.config.DBPoolMaxConnIdleTime {
+		pgxpoolConfig.MaxConnIdleTime = time.Duration(s.config.DBPoolMaxConnIdleTime) * time.Second
+	}
+	if 0 < s.config.DBPoolMaxConnLifetime {
+		pgxpoolConfig.MaxConnLifetime = time.Duration(s.config.DBPoolMaxConnLifetime) * time.Second
+	}
+	if 0 < s.config.DBHealthCheckInterval {
+		pgxpoolConfig.HealthCheckPeriod = time.Duration(s.config.DBHealthCheckInterval) * time.Second
+	}
+	if s.config.DBAfterConnect != "" {
+		pgxpoolConfig.AfterConnect = s.AfterConnect
+	}
+	if s.config.DBPingOnAcquire {
+		pgxpoolConfig.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+			// NOTE a connection failing the ping is destroyed and another is acquired
+			return conn.Ping(ctx) == nil
+		}
+	}
+	return pgxpool.NewWithConfig(context.Background(), pgxpoolConfig)
+}
+
+// AfterConnect runs the DBAfterConnect SQL on a new connection
+// NOTE the simple protocol is used so the file may hold multiple statements
+func (s *servotron) AfterConnect(ctx context.Context, conn *pgx.Conn) error {
+	q, err := s.files.ReadFile(s.config.DBAfterConnect)
+	if err != nil {
+		return err
+	}
+	_, err = conn.PgConn().Exec(ctx, string(q)).ReadAll()
+	return err
+}
+
+// AuthDatabase returns the name of the database the authorization query of the request runs in
+// NOTE the route database unless AuthDatabase is configured
+func (s *servotron) AuthDatabase(r *http.Request) string {
+	if s.config.AuthDatabase != "" {
+		return s.config.AuthDatabase
+	}
+	route, _ := RequestRoute(r)
+	return route.Database
+}
+
+// BeginTx begins a transaction in the named database for the request
+func (s *servotron) BeginTx(ctx context.Context, r *http.Request, dbName string, readOnly bool) (pgx.Tx, error) {
+	if !s.databases[dbName].available.Load() {
+		return nil, fmt.Errorf("%w: %q", ErrDatabaseUnavailable, dbName)
+	}
+	return s.RequestPool(r, dbName).BeginTx(ctx, s.TxOptions(r, readOnly))
+}
+
+// TxOptions returns the transaction options of the request
+// NOTE the route IsolationLevel takes precedence over DBIsolationLevel
+func (s *servotron) TxOptions(r *http.Request, readOnly bool) pgx.TxOptions {
+	route, _ := RequestRoute(r)
+	isoLevel := s.config.DBIsolationLevel
+	if route.IsolationLevel != "" {
+		isoLevel = strings.ToLower(route.IsolationLevel)
+	}
+	result := pgx.TxOptions{IsoLevel: pgx.TxIsoLevel(isoLevel)}
+	if readOnly {
+		result.AccessMode = pgx.ReadOnly
+	}
+	return result
+}
+
+// ReadOnly reports whether the request runs in a read only transaction
+// NOTE GET requests of read routes and templates are read only unless the route sets ReadWrite
+func (s *servotron) ReadOnly(r *http.Request) bool {
+	route, _ := RequestRoute(r)
+	return r.Method == http.MethodGet && route.Type != "service" && !route.ReadWrite
+}
+
+// RequestPool returns the pool of the named database for the request
+// NOTE GET requests of read routes and templates are served by a healthy reader unless the route sets Primary or ReadWrite
+// NOTE readers may be hot standbys, which reject the side effects of ReadWrite routes
+func (s *servotron) RequestPool(r *http.Request, dbName string) *pgxpool.Pool {
+	db := s.databases[dbName]
+	route, _ := RequestRoute(r)
+	if r.Method == http.MethodGet && route.Type != "service" && !route.Primary && !route.ReadWrite {
+		if pool := db.readers.Next(); pool != nil {
+			return pool
+		}
+	}
+	return db.pool
+}
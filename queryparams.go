@@ -0,0 +1,290 @@
+package servotron
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// NOTE if query param json changes, then the query param struct must change
+// NOTE Min and Max bound the value of integer and number params and the length of other params
+// NOTE Array params collect repeated keys and are passed as a text array
+type QueryParam struct {
+	Name     string
+	Type     string
+	Required bool     `json:",omitempty"`
+	Default  string   `json:"-"`
+	Pattern  string   `json:",omitempty"`
+	Min      *float64 `json:",omitempty"`
+	Max      *float64 `json:",omitempty"`
+	Enum     []string `json:",omitempty"`
+	Array    bool     `json:",omitempty"`
+	// runtime
+	pattern    *regexp.Regexp
+	hasDefault bool
+}
+
+// QueryParams accepts either a list of query param specs
+// or the flat list of name and "{name}" pairs
+type QueryParams []QueryParam
+
+func (q *QueryParams) UnmarshalJSON(b []byte) error {
+	var flat []string
+	if json.Unmarshal(b, &flat) == nil {
+		*q = (*q)[:0]
+		for i, name := range flat {
+			if i%2 == 0 {
+				*q = append(*q, QueryParam{Name: name, Type: "string"})
+			}
+		}
+		return nil
+	}
+	var specs []QueryParam
+	err := json.Unmarshal(b, &specs)
+	if err != nil {
+		return err
+	}
+	*q = specs
+	return nil
+}
+
+func (p *QueryParam) UnmarshalJSON(b []byte) error {
+	type spec QueryParam
+	aux := struct {
+		*spec
+		Default json.RawMessage
+	}{spec: (*spec)(p)}
+	err := json.Unmarshal(b, &aux)
+	if err != nil {
+		return err
+	}
+	if p.Type == "" {
+		p.Type = "string"
+	}
+	// NOTE defaults may be written as JSON strings, numbers or booleans
+	if 0 < len(aux.Default) && !bytes.Equal(aux.Default, []byte("null")) {
+		p.hasDefault = true
+		err = json.Unmarshal(aux.Default, &p.Default)
+		if err != nil {
+			p.Default = string(aux.Default)
+		}
+	}
+	return p.Compile()
+}
+
+// Compile compiles the Pattern of the spec
+func (p *QueryParam) Compile() error {
+	if p.Pattern == "" {
+		return nil
+	}
+	var err error
+	p.pattern, err = regexp.Compile(p.Pattern)
+	if err != nil {
+		return fmt.Errorf("query param %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+func (p QueryParam) MarshalJSON() ([]byte, error) {
+	type spec QueryParam
+	aux := struct {
+		spec
+		Default *string `json:",omitempty"`
+	}{spec: spec(p)}
+	if p.hasDefault {
+		aux.Default = &p.Default
+	}
+	return json.Marshal(aux)
+}
+
+func (q QueryParams) Names() []string {
+	var result []string
+	for _, p := range q {
+		result = append(result, p.Name)
+	}
+	return result
+}
+
+// Check returns a problem with the spec itself, such as an unknown type or an invalid default
+func (p QueryParam) Check() error {
+	switch p.Type {
+	case "string", "integer", "number", "boolean", "uuid", "date":
+	default:
+		return fmt.Errorf("query param %s: unknown type %q", p.Name, p.Type)
+	}
+	if p.Name == "" {
+		return fmt.Errorf("query param missing name")
+	}
+	if p.hasDefault {
+		err := p.Validate(p.Default)
+		if err != nil {
+			return fmt.Errorf("query param %s: default: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks a single value against the spec
+func (p QueryParam) Validate(value string) error {
+	invalid := &ParamError{Name: p.Name, Type: p.Type, Value: value}
+	length := float64(utf8.RuneCountInString(value))
+	switch p.Type {
+	case "integer", "number":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return invalid
+		}
+		// NOTE NaN and infinities have no JSON encoding
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			invalid.Reason = "is not a finite number"
+			return invalid
+		}
+		if p.Type == "integer" {
+			_, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return invalid
+			}
+		}
+		length = n
+	case "boolean":
+		_, _, ok := CoerceParam(pgtype.BoolOID, value)
+		if !ok {
+			return invalid
+		}
+	case "uuid":
+		if !uuidPattern.MatchString(value) {
+			return invalid
+		}
+	case "date":
+		_, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return invalid
+		}
+	}
+	if p.Min != nil && length < *p.Min {
+		invalid.Reason = fmt.Sprintf("is less than the minimum %v", *p.Min)
+		return invalid
+	}
+	if p.Max != nil && *p.Max < length {
+		invalid.Reason = fmt.Sprintf("is greater than the maximum %v", *p.Max)
+		return invalid
+	}
+	if p.pattern != nil && !p.pattern.MatchString(value) {
+		invalid.Reason = fmt.Sprintf("does not match %s", p.Pattern)
+		return invalid
+	}
+	if 0 < len(p.Enum) {
+		for _, e := range p.Enum {
+			if e == value {
+				return nil
+			}
+		}
+		invalid.Reason = fmt.Sprintf("is not one of %s", strings.Join(p.Enum, ", "))
+		return invalid
+	}
+	return nil
+}
+
+// Values returns the validated values of the param, or the default
+// NOTE empty values are treated as missing
+func (p QueryParam) Values(query url.Values) ([]string, error) {
+	var result []string
+	for _, value := range query[p.Name] {
+		if value != "" {
+			result = append(result, value)
+		}
+		if !p.Array {
+			break
+		}
+	}
+	if len(result) == 0 && p.hasDefault {
+		result = append(result, p.Default)
+	}
+	if len(result) == 0 && p.Required {
+		return result, &ParamError{Name: p.Name, Type: p.Type, Reason: "is required"}
+	}
+	for _, value := range result {
+		err := p.Validate(value)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// Extract returns a SQL argument for each query param, in order
+// NOTE missing params are NULL and array params are text arrays
+func (q QueryParams) Extract(query url.Values) ([]interface{}, error) {
+	var result []interface{}
+	for _, p := range q {
+		values, err := p.Values(query)
+		if err != nil {
+			return result, err
+		}
+		switch {
+		case len(values) == 0:
+			result = append(result, pgtype.Text{String: "", Valid: false})
+		case p.Array:
+			result = append(result, values)
+		default:
+			result = append(result, pgtype.Text{String: values[0], Valid: true})
+		}
+	}
+	return result, nil
+}
+
+// JSONValue returns a validated value as JSON
+// NOTE integer and number values are parsed into JSON numbers, so inputs such as 01 or +5 are encoded as 1 and 5
+// NOTE boolean values are JSON booleans
+func (p QueryParam) JSONValue(value string) interface{} {
+	switch p.Type {
+	case "integer":
+		n, _ := strconv.ParseInt(value, 10, 64)
+		return n
+	case "number":
+		n, _ := strconv.ParseFloat(value, 64)
+		return n
+	case "boolean":
+		b, _, _ := CoerceParam(pgtype.BoolOID, value)
+		return b
+	}
+	return value
+}
+
+// ExtractJSON returns the query string as a JSON object
+// NOTE params with a spec are validated, defaulted and typed, other params are passed through as strings
+func (q QueryParams) ExtractJSON(query url.Values) (string, error) {
+	result := make(map[string]interface{})
+	for k, v := range query {
+		result[k] = v[0]
+	}
+	for _, p := range q {
+		delete(result, p.Name)
+		values, err := p.Values(query)
+		if err != nil {
+			return "", err
+		}
+		var typed []interface{}
+		for _, value := range values {
+			typed = append(typed, p.JSONValue(value))
+		}
+		switch {
+		case len(typed) == 0:
+		case p.Array:
+			result[p.Name] = typed
+		default:
+			result[p.Name] = typed[0]
+		}
+	}
+	j, err := json.Marshal(result)
+	return string(j), err
+}
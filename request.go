@@ -0,0 +1,139 @@
+package servotron
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ParseTrustedProxies parses the trusted proxy IPs and CIDRs
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return result, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return result, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// IsTrustedProxy reports whether the IP is a trusted proxy
+func (s *servotron) IsTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range s.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client
+// NOTE X-Forwarded-For is walked from the right, skipping trusted proxies, only if the peer is a trusted proxy
+// NOTE the walk stops at a hop that is not an IP, leaving the nearest trusted proxy as the client
+func (s *servotron) ClientIP(r *http.Request) string {
+	result, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		result = r.RemoteAddr
+	}
+	if !s.IsTrustedProxy(result) {
+		return result
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; 0 <= i; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			break
+		}
+		result = ip.String()
+		if !s.IsTrustedProxy(result) {
+			break
+		}
+	}
+	return result
+}
+
+// RequestID sets the request ID header on the request, if missing, and on the response
+func (s *servotron) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(s.config.RequestIDHeader)
+		if requestID == "" {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err == nil {
+				requestID = hex.EncodeToString(b)
+				r.Header.Set(s.config.RequestIDHeader, requestID)
+			}
+		}
+		w.Header().Set(s.config.RequestIDHeader, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestSettings returns the names and values of the request.* settings
+// NOTE request.headers is a JSON object of the RequestHeaders allowlist, keyed by lower case header name
+func (s *servotron) RequestSettings(r *http.Request, apiVersion string) ([]string, []string, error) {
+	routeName := ""
+	if route := mux.CurrentRoute(r); route != nil {
+		routeName = route.GetName()
+	}
+	headers := make(map[string]string)
+	for _, name := range s.config.RequestHeaders {
+		if values := r.Header.Values(name); 0 < len(values) {
+			headers[strings.ToLower(name)] = strings.Join(values, ", ")
+		}
+	}
+	j, err := json.Marshal(headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := []string{
+		"request.ip",
+		"request.method",
+		"request.path",
+		"request.route",
+		"request.version",
+		"request.id",
+		"request.accept_language",
+		"request.headers",
+	}
+	values := []string{
+		s.ClientIP(r),
+		r.Method,
+		r.URL.Path,
+		routeName,
+		apiVersion,
+		r.Header.Get(s.config.RequestIDHeader),
+		r.Header.Get("Accept-Language"),
+		string(j),
+	}
+	return names, values, nil
+}
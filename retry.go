@@ -0,0 +1,97 @@
+package servotron
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// bufferedResponse holds a response until it is known whether the request is retried
+// NOTE err is the error passed to TeeError, if any
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	err    error
+}
+
+func NewBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// Send writes the buffered response to w
+func (b *bufferedResponse) Send(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	if b.status != 0 {
+		w.WriteHeader(b.status)
+	}
+	w.Write(b.body.Bytes())
+}
+
+// IsRetryable reports whether the transaction failed with a serialization failure or a deadlock
+func IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
+
+// RetryReq retries the whole request, authorization included, on serialization failures and deadlocks
+// NOTE the request body and the response are buffered, so an attempt can be replayed and discarded
+// NOTE attempts back off exponentially from DBRetryBackoff with full jitter
+func (s *servotron) RetryReq(wrapped func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			s.TeeError(w, err)
+			return
+		}
+		backoff := time.Duration(s.config.DBRetryBackoff) * time.Millisecond
+		for attempt := 1; ; attempt++ {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			response := NewBufferedResponse()
+			wrapped(response, r)
+			if attempt < s.config.DBRetryAttempts && IsRetryable(response.err) {
+				delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+				log.Println("RetryReq", "attempt", attempt, "failed, retrying in", delay, response.err)
+				select {
+				case <-time.After(delay):
+					backoff *= 2
+					continue
+				case <-r.Context().Done():
+					s.TeeError(w, r.Context().Err())
+					return
+				}
+			}
+			response.Send(w)
+			return
+		}
+	}
+}
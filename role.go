@@ -0,0 +1,75 @@
+package servotron
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrRoleNotAllowed is returned when the role of the app user is missing or not in the Allow list
+var ErrRoleNotAllowed = errors.New("role not allowed")
+
+// QueueRole queues the set local role of the app user
+// NOTE the role is checked against the Allow list on the server, no row is returned if it is not allowed
+func (s *servotron) QueueRole(batch *pgx.Batch, r *http.Request) error {
+	q := `select set_config('role', role, true)
+from (select coalesce(nullif(%s, ''), $2) as role) as app_user_role
+where role = any($3)`
+	allow := splitList(s.config.AppUserRole["Allow"])
+	var defaultRole *string
+	if s.config.AppUserRole["Default"] != "" {
+		role := s.config.AppUserRole["Default"]
+		defaultRole = &role
+	}
+	switch s.config.AppUserRole["From"] {
+	case "Claim":
+		role, err := s.GetAppUserRoleClaim(r)
+		if err != nil {
+			return err
+		}
+		batch.Queue(fmt.Sprintf(q, "$1::text"), role, defaultRole, allow)
+	case "LocalParam":
+		// NOTE the local param is set earlier in the batch
+		batch.Queue(fmt.Sprintf(q, "current_setting($1, true)"), "app_user."+s.config.AppUserRole["Name"], defaultRole, allow)
+	default:
+		return fmt.Errorf("invalid AppUserRole From %q", s.config.AppUserRole["From"])
+	}
+	return nil
+}
+
+// GetAppUserRoleClaim returns the role claim of the app user JWT
+// NOTE a missing claim is empty, so the Default role applies
+// NOTE the payload verified by WithAppUserAuth is taken from the request context
+func (s *servotron) GetAppUserRoleClaim(r *http.Request) (string, error) {
+	if auth, ok := r.Context().Value(appUserAuthContextKey).(appUserAuth); ok {
+		if auth.payload == nil {
+			return "", nil
+		}
+		role, _, err := JWTClaim(auth.payload, s.config.AppUserRole["Name"])
+		return role, err
+	}
+	var token string
+	switch s.config.AppUserAuth["ParseFrom"] {
+	case "Header":
+		split := strings.Split(r.Header.Get(s.config.AppUserAuth["Field"]), " ")
+		token = split[len(split)-1]
+	case "Cookie":
+		cookie, err := r.Cookie(s.config.AppUserAuth["Name"])
+		if err != nil {
+			return "", nil
+		}
+		token = cookie.Value
+	}
+	if token == "" {
+		return "", nil
+	}
+	payload, err := s.JWTPayload(token)
+	if err != nil {
+		return "", err
+	}
+	role, _, err := JWTClaim(payload, s.config.AppUserRole["Name"])
+	return role, err
+}
@@ -1,11 +1,67 @@
 package servotron
 
+import (
+	"net/http"
+	"time"
+)
+
 // NOTE if route json changes, then the route struct must change
 type Route struct {
 	Name        string
 	Type        string
 	URLScheme   string
-	QueryParams []string
+	QueryParams QueryParams
 	ServiceURL  string
 	Description string
+	// NOTE read routes with Primary are served by the writer, for read after write consistency
+	Primary bool `json:",omitempty"`
+	// NOTE the name of a configured database, the default database if empty
+	Database string `json:",omitempty"`
+	// NOTE a duration such as 500ms or 30s, DBQueryTimeout if empty
+	Timeout string `json:",omitempty"`
+	// NOTE set local in the request transaction before the route SQL runs, such as statement_timeout or work_mem
+	Settings map[string]string `json:",omitempty"`
+	// NOTE read routes run in read only transactions unless ReadWrite, for SQL with intended side effects
+	ReadWrite bool `json:",omitempty"`
+	// NOTE read committed, repeatable read or serializable, DBIsolationLevel if empty
+	IsolationLevel string `json:",omitempty"`
+	// NOTE read routes with RowSet return the rows and columns of the SQL rather than a single JSON value
+	RowSet bool `json:",omitempty"`
+	// NOTE read routes with Stream return one JSON object per row, written as the rows are read rather than buffered
+	// NOTE an error after the first byte is written aborts the response, so the client sees a truncated body rather than a problem
+	Stream bool `json:",omitempty"`
+	// NOTE limits of RowSet and Stream responses, and the bytes of export responses, no limit if zero
+	// NOTE a response over a limit is a problem if nothing is written yet, else it is aborted and truncated
+	MaxRows  int   `json:",omitempty"`
+	MaxBytes int64 `json:",omitempty"`
+	// NOTE the HTTP methods of a transaction route, each authorized by its own auth SQL
+	Methods []string `json:",omitempty"`
+}
+
+// transactionMethods map the methods of transaction routes to their auth SQL dirs
+var transactionMethods = map[string]string{
+	http.MethodPost:   "insert",
+	http.MethodPut:    "update",
+	http.MethodDelete: "delete",
+}
+
+// TransactionMethods returns the route Methods, or POST, PUT and DELETE if there are none
+func (r Route) TransactionMethods() []string {
+	if len(r.Methods) == 0 {
+		return []string{http.MethodPost, http.MethodPut, http.MethodDelete}
+	}
+	return r.Methods
+}
+
+// QueryTimeout returns the route Timeout, or the fallback if there is none
+// NOTE Timeout is validated when routes load
+func (r Route) QueryTimeout(fallback time.Duration) time.Duration {
+	if r.Timeout == "" {
+		return fallback
+	}
+	timeout, err := time.ParseDuration(r.Timeout)
+	if err != nil || timeout <= 0 {
+		return fallback
+	}
+	return timeout
 }
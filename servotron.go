@@ -1,7 +1,6 @@
 package servotron
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/base64"
@@ -10,13 +9,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
 	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -24,30 +23,85 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
-	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type contextKey int
+
+const (
+	txContextKey contextKey = iota
+	routeContextKey
+	appUserAuthContextKey
 )
 
 type servotron struct {
-	config Config
-	pool   *pgxpool.Pool
-	router *mux.Router
-	server *http.Server
+	config      Config
+	databases   map[string]*database
+	router      *mux.Router
+	server      *http.Server
+	jwtVerifier *jwtVerifier
+	files       *fileCache
+	statements  *statementCache
+	// NOTE parsed TrustedProxies
+	trustedProxies []*net.IPNet
 }
 
 func NewServer(cfg Config) (servotron, error) {
-	servo := servotron{config: cfg}
-	pgxpoolConfig, err := pgxpool.ParseConfig(servo.config.DBConnString)
+	servo := servotron{
+		config:     cfg,
+		files:      NewFileCache(),
+		statements: NewStatementCache(),
+	}
+	trustedProxies, err := ParseTrustedProxies(cfg.TrustedProxies)
 	if err != nil {
 		return servo, err
 	}
-	pgxpoolConfig.MinConns = int32(servo.config.DBPoolSize)
-	pgxpoolConfig.MaxConns = int32(servo.config.DBPoolSize)
-	// TODO implement AfterConnect to check connections
-	pool, err := pgxpool.NewWithConfig(context.Background(), pgxpoolConfig)
+	servo.trustedProxies = trustedProxies
+	if 0 < cfg.FileWatchInterval {
+		go servo.files.Watch(time.Duration(cfg.FileWatchInterval) * time.Second)
+	}
+	if cfg.AppUserAuth["Type"] == "JWT" && cfg.AppUserAuth["Verify"] == "true" {
+		verifier, err := NewJWTVerifier(cfg.AppUserAuth)
+		if err != nil {
+			return servo, err
+		}
+		servo.jwtVerifier = verifier
+	}
+	// NOTE the unnamed database is the DBConnString writer and its DBReaderConnStrings
+	servo.databases = make(map[string]*database)
+	db, err := servo.NewDatabase(Database{
+		ConnString:        cfg.DBConnString,
+		ReaderConnStrings: cfg.DBReaderConnStrings,
+	})
 	if err != nil {
 		return servo, err
 	}
-	servo.pool = pool
+	servo.databases[""] = db
+	for name, dbConfig := range cfg.Databases {
+		db, err := servo.NewDatabase(dbConfig)
+		if err != nil {
+			return servo, fmt.Errorf("database %s: %w", name, err)
+		}
+		servo.databases[name] = db
+	}
+	if cfg.DBAfterConnect != "" {
+		_, err = servo.files.ReadFile(cfg.DBAfterConnect)
+		if err != nil {
+			return servo, err
+		}
+	}
+	// NOTE the server starts even if a database is not yet up
+	timeout := time.Duration(cfg.DBQueryTimeout) * time.Second
+	for name, db := range servo.databases {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = db.pool.Ping(ctx)
+		cancel()
+		if err == nil {
+			db.available.Store(true)
+			continue
+		}
+		log.Println("NewServer", "starting degraded, database", name, "unavailable", err)
+		go db.Connect(name, timeout)
+	}
 	servo.server = &http.Server{Addr: ":" + cfg.ListenPort}
 	return servo, nil
 }
@@ -67,6 +121,8 @@ func (s *servotron) LoadRouter(routes []Route) error {
 	return err
 }
 
+// NOTE with ?dryRun=true routes are validated but not loaded
+// NOTE invalid routes are rejected with the validation report and the loaded routes are kept
 func (s *servotron) LoadRoutesHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("loading routes")
 	bytes, err := ioutil.ReadAll(r.Body)
@@ -77,7 +133,27 @@ func (s *servotron) LoadRoutesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	routes, err := s.GetRoutesFromBytes(bytes)
+	if err != nil {
+		log.Println(s.FormatErr(err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(s.FormatErr(err.Error()))
+		return
+	}
+	if r.URL.Query().Get("dryRun") == "true" {
+		report := s.ValidateRoutes(routes)
+		if !report.Valid {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		s.WriteReport(w, report)
+		return
+	}
 	err = s.LoadRouter(routes)
+	var report *RouteReport
+	if errors.As(err, &report) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		s.WriteReport(w, report)
+		return
+	}
 	if err != nil {
 		log.Println(s.FormatErr(err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -97,22 +173,43 @@ func (s *servotron) LoadRoutesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
-func (s *servotron) GetRoutesFromBytes(bytes []byte) ([]Route, error) {
+func (s *servotron) WriteReport(w http.ResponseWriter, report *RouteReport) {
+	j, err := json.Marshal(report)
+	if err != nil {
+		log.Println(s.FormatErr(err.Error()))
+		return
+	}
+	w.Write(j)
+}
+
+// NOTE a JSON array is a list of routes, anything else is an OpenAPI 3 document
+func (s *servotron) GetRoutesFromBytes(b []byte) ([]Route, error) {
 	var result []Route
 	var err error
-	if 0 < len(bytes) {
-		err = json.Unmarshal(bytes, &result)
+	trimmed := bytes.TrimSpace(b)
+	if 0 < len(trimmed) {
+		if trimmed[0] == '[' {
+			err = json.Unmarshal(trimmed, &result)
+		} else {
+			result, err = s.GetRoutesFromOpenAPI(trimmed)
+		}
 	}
 	return result, err
 }
 
 func (s *servotron) CreateRouter(routes []Route) (*mux.Router, error) {
 	router := mux.NewRouter()
-	s.config.Routes = routes
-	err := s.LoadRoutes(router, s.config.Routes)
+	router.Use(s.RequestID)
+	router.Use(s.VersionHeaders)
+	err := s.LoadRoutes(router, routes)
 	if err != nil {
 		return router, err
 	}
+	s.config.Routes = routes
+	// NOTE registered before the file and template servers, which may serve every path
+	if s.config.OpenAPI == "public" {
+		router.HandleFunc("/openapi.json", s.OpenAPIHandler).Methods("GET")
+	}
 	for endpoint, dir := range s.config.FileServers {
 		router.PathPrefix(endpoint).Handler(http.FileServer(http.Dir(dir)))
 	}
@@ -123,8 +220,12 @@ func (s *servotron) CreateRouter(routes []Route) (*mux.Router, error) {
 }
 
 func (s *servotron) LoadRoutes(router *mux.Router, routes []Route) error {
+	report := s.ValidateRoutes(routes)
+	if !report.Valid {
+		return report
+	}
 	err := error(nil)
-	s.config.QueryParams = make(map[string][]string)
+	queryParams := make(map[string]QueryParams)
 	for _, r := range routes {
 		switch r.Type {
 		case "service":
@@ -137,17 +238,22 @@ func (s *servotron) LoadRoutes(router *mux.Router, routes []Route) error {
 			serviceAuthFunc := s.AuthorizeReq(serviceProxy.ServeHTTP)
 			serviceFunc := s.CreateServiceFunc(r.URLScheme, serviceAuthFunc)
 			router.PathPrefix(r.URLScheme).
-				HandlerFunc(serviceFunc).
+				HandlerFunc(s.WithRoute(r, serviceFunc)).
 				Name(r.Name).
 				Methods("GET", "POST", "PUT", "DELETE", "PATCH", "CONNECT")
 		case "read":
 			// store query params in global config mapped to route name
-			s.config.QueryParams[r.Name] = r.QueryParams
+			queryParams[r.Name] = r.QueryParams
 			httpMethod := "GET"
 			log.Println(r.Name)
-			router.HandleFunc(r.URLScheme, s.AuthorizeReq(s.QueryHandler)).
+			router.HandleFunc(r.URLScheme, s.WithRoute(r, s.AuthorizeReq(s.QueryHandler))).
 				Name(r.Name).
 				Methods(httpMethod)
+		case "export":
+			queryParams[r.Name] = r.QueryParams
+			router.HandleFunc(r.URLScheme, s.WithRoute(r, s.AuthorizeReq(s.ExportHandler))).
+				Name(r.Name).
+				Methods("GET")
 		case "create", "update", "delete":
 			httpMethod := ""
 			switch r.Type {
@@ -158,21 +264,35 @@ func (s *servotron) LoadRoutes(router *mux.Router, routes []Route) error {
 			default:
 				httpMethod = "DELETE"
 			}
-			router.HandleFunc(r.URLScheme, s.AuthorizeReq(s.ExecHandler)).
+			router.HandleFunc(r.URLScheme, s.WithRoute(r, s.RetryReq(s.AuthorizeReq(s.ExecHandler)))).
 				Name(r.Name).
 				Methods(httpMethod)
 		case "transaction":
 			router.HandleFunc(
 				r.URLScheme,
-				s.AuthorizeReq(s.TransactionHandler)).
+				s.WithRoute(r, s.RetryReq(s.AuthorizeReq(s.TransactionHandler)))).
 				Name(r.Name).
-				Methods("POST", "PUT", "DELETE")
+				Methods(r.TransactionMethods()...)
 		default:
 		}
 	}
+	s.config.QueryParams = queryParams
 	return err
 }
 
+// ReloadHandler drops the file cache and preloads the SQL files of the loaded routes
+func (s *servotron) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("reloading files")
+	s.files.Reload()
+	s.statements.Reload()
+	report := s.ValidateRoutes(s.config.Routes)
+	if !report.Valid {
+		log.Println(report)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	s.WriteReport(w, report)
+}
+
 func (s *servotron) AuthorizeReq(wrapped func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	CrudMap := make(map[string]string)
 	CrudMap[http.MethodGet] = "select"
@@ -185,7 +305,11 @@ func (s *servotron) AuthorizeReq(wrapped func(http.ResponseWriter, *http.Request
 	return func(w http.ResponseWriter, r *http.Request) {
 		currentRoute := mux.CurrentRoute(r)
 		routeName := currentRoute.GetName()
-		apiVersion := r.Header.Get("Version")
+		apiVersion, err := s.ResolveVersion(r)
+		if err != nil {
+			s.TeeError(w, err)
+			return
+		}
 		isServiceReq, err := s.IsServiceRequest(currentRoute)
 		if err != nil {
 			s.TeeError(w, err)
@@ -195,14 +319,10 @@ func (s *servotron) AuthorizeReq(wrapped func(http.ResponseWriter, *http.Request
 		if isServiceReq {
 			reqType = "service"
 		}
-		authPath := fmt.Sprintf(
-			"%s/%s/auth/%s/%s.sql",
-			s.config.SQLRoot,
-			apiVersion,
-			reqType,
-			routeName)
-		authPath = filepath.Clean(authPath)
-		q, err := os.ReadFile(authPath)
+		if route, _ := RequestRoute(r); route.Type == "export" {
+			reqType = "export"
+		}
+		q, _, err := s.ReadSQL(apiVersion, "auth", reqType, routeName+".sql")
 		if err != nil {
 			s.TeeError(w, err)
 			return
@@ -212,39 +332,130 @@ func (s *servotron) AuthorizeReq(wrapped func(http.ResponseWriter, *http.Request
 			s.TeeError(w, err)
 			return
 		}
+		// NOTE verify app user auth before any SQL runs
+		r, err = s.WithAppUserAuth(r)
+		if err != nil {
+			s.TeeError(w, err)
+			return
+		}
 		log.Println("AuthorizeReq", "authorizing", r.Method, routeName, params)
 		var isAuthorized bool
-		tx, err := s.pool.Begin(context.Background())
+		route, _ := RequestRoute(r)
+		authDatabase := s.AuthDatabase(r)
+		ctx, cancel := s.DBContext(r)
+		defer cancel()
+		// NOTE the authorizing transaction is read only if the route SQL does not run in it
+		readOnly := s.ReadOnly(r) || isServiceReq || authDatabase != route.Database
+		tx, err := s.BeginTx(ctx, r, authDatabase, readOnly)
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
 		defer tx.Rollback(context.Background())
-		err = s.SetLocalParams(&tx, r)
+		// NOTE local params and the auth query are pipelined in one round trip
+		batch, names, err := s.LocalParamsBatch(r)
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
-		err = tx.QueryRow(
-			context.Background(),
-			string(q),
-			params...).
-			Scan(&isAuthorized)
+		// NOTE undescribed auth SQL is described after the local params are set, so the route settings and role apply
+		if _, ok := s.statements.Get(StatementKey(ctx, tx.Conn(), string(q))); !ok {
+			err = s.SendLocalParams(ctx, tx, batch, names)
+			if err != nil {
+				s.TeeError(w, err)
+				return
+			}
+			batch = &pgx.Batch{}
+			names = nil
+		}
+		params, err = s.CoerceParams(ctx, tx, string(q), s.ParamNames(r), params)
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
-		err = tx.Commit(context.Background())
+		batch.Queue(string(q), params...)
+		br := tx.SendBatch(ctx, batch)
+		err = s.ReadLocalParams(br, names)
 		if err != nil {
+			br.Close()
 			s.TeeError(w, err)
 			return
 		}
-		if isAuthorized {
-			wrapped(w, r)
-		} else {
+		err = br.QueryRow().Scan(&isAuthorized)
+		if err != nil {
+			br.Close()
+			s.TeeError(w, err)
+			return
+		}
+		err = br.Close()
+		if err != nil {
+			s.TeeError(w, err)
+			return
+		}
+		if !isAuthorized {
 			w.WriteHeader(http.StatusForbidden)
+			return
 		}
+		// NOTE the transaction is not held open while proxying to a service
+		// NOTE if auth runs in another database, then the wrapped handler begins its own transaction
+		if isServiceReq || authDatabase != route.Database {
+			err = tx.Commit(ctx)
+			if err != nil {
+				s.TeeError(w, err)
+				return
+			}
+			wrapped(w, r)
+			return
+		}
+		// NOTE the wrapped handler runs in the authorizing transaction and commits it
+		txCtx := context.WithValue(r.Context(), txContextKey, tx)
+		wrapped(w, r.WithContext(txCtx))
+	}
+}
+
+// WithRoute passes the route in the request context
+func (s *servotron) WithRoute(route Route, wrapped func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), routeContextKey, route)
+		wrapped(w, r.WithContext(ctx))
+	}
+}
+
+// RequestRoute returns the route of the request
+// NOTE template and file server requests have no route
+func RequestRoute(r *http.Request) (Route, bool) {
+	route, ok := r.Context().Value(routeContextKey).(Route)
+	return route, ok
+}
+
+// DBContext returns the context of the database work of the request
+// NOTE derived from the request context, so a client disconnect cancels the query, with the route timeout on top
+func (s *servotron) DBContext(r *http.Request) (context.Context, context.CancelFunc) {
+	route, _ := RequestRoute(r)
+	timeout := route.QueryTimeout(time.Duration(s.config.DBQueryTimeout) * time.Second)
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// RequestTx returns the transaction opened by AuthorizeReq for the request
+// NOTE if there is none, a new transaction is begun with local params set
+// NOTE transactions are rolled back with the background context, so a canceled request still releases its connection
+func (s *servotron) RequestTx(r *http.Request) (pgx.Tx, error) {
+	if tx, ok := r.Context().Value(txContextKey).(pgx.Tx); ok {
+		return tx, nil
+	}
+	ctx, cancel := s.DBContext(r)
+	defer cancel()
+	route, _ := RequestRoute(r)
+	tx, err := s.BeginTx(ctx, r, route.Database, s.ReadOnly(r))
+	if err != nil {
+		return tx, err
+	}
+	err = s.SetLocalParams(ctx, &tx, r)
+	if err != nil {
+		tx.Rollback(context.Background())
+		return tx, err
 	}
+	return tx, nil
 }
 
 func (s *servotron) IsServiceRequest(r *mux.Route) (bool, error) {
@@ -272,31 +483,50 @@ func (s *servotron) CreateServiceFunc(prefix string, wrapped func(http.ResponseW
 
 func (s *servotron) QueryHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept")
 	routeName := mux.CurrentRoute(r).GetName()
-	apiVersion := r.Header.Get("Version")
+	apiVersion, err := s.ResolveVersion(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	contentType, err := Negotiate(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
 	params, err := s.ExtractParams(r)
 	if err != nil {
 		s.TeeError(w, err)
 		return
 	}
 	log.Println("QueryHandler", "processing", r.Method, routeName, params)
-	tx, err := s.pool.Begin(context.Background())
+	tx, err := s.RequestTx(r)
 	if err != nil {
 		s.TeeError(w, err)
 		return
 	}
 	defer tx.Rollback(context.Background())
-	err = s.SetLocalParams(&tx, r)
-	if err != nil {
-		s.TeeError(w, err)
+	ctx, cancel := s.DBContext(r)
+	defer cancel()
+	if route, _ := RequestRoute(r); route.RowSet || route.Stream {
+		rows, err := s.QueryRows(ctx, &tx, apiVersion, routeName, s.ParamNames(r), params)
+		if err != nil {
+			s.TeeError(w, err)
+			return
+		}
+		err = s.EncodeRows(ctx, w, contentType, route, tx, rows)
+		if err != nil {
+			s.TeeError(w, err)
+		}
 		return
 	}
-	result, n, err := s.Query(&tx, r.Method, apiVersion, routeName, params)
+	result, n, err := s.Query(ctx, &tx, r.Method, apiVersion, routeName, s.ParamNames(r), params)
 	if err != nil {
 		s.TeeError(w, err)
 		return
 	}
-	err = tx.Commit(context.Background())
+	err = tx.Commit(ctx)
 	if err != nil {
 		s.TeeError(w, err)
 		return
@@ -310,61 +540,83 @@ func (s *servotron) QueryHandler(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
 		}
 	}
+	if contentType != "application/json" && 0 < len(result) {
+		err = s.EncodeJSON(w, contentType, result)
+		if err != nil {
+			s.TeeError(w, err)
+		}
+		return
+	}
 	w.Write(result)
 }
 
-func (s *servotron) Query(tx *pgx.Tx, method string, apiVersion string, routeName string, params []interface{}) ([]byte, int64, error) {
+func (s *servotron) Query(ctx context.Context, tx *pgx.Tx, method string, apiVersion string, routeName string, names []string, params []interface{}) ([]byte, int64, error) {
 	var result []byte
 	var n int64
-	pathTmpl := ""
 	switch method {
 	case http.MethodGet:
-		pathTmpl = "%s/%s/select/%s.sql"
 	default:
 		return result, n, errors.New("invalid http method for query execution")
 	}
-	path := fmt.Sprintf(pathTmpl, s.config.SQLRoot, apiVersion, routeName)
-	path = filepath.Clean(path)
-	q, err := os.ReadFile(path)
+	rows, err := s.QueryRows(ctx, tx, apiVersion, routeName, names, params)
 	if err != nil {
 		return result, n, err
 	}
-	log.Println("Query", "executing", path, params)
-	timeout := time.Duration(s.config.DBQueryTimeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	rows, err := (*tx).Query(ctx, string(q), params...)
 	defer rows.Close()
-	if err != nil {
-		return result, n, err
-	}
 	for rows.Next() {
 		result = rows.RawValues()[0]
 	}
+	// NOTE a canceled or timed out query ends the rows early
+	err = rows.Err()
+	if err != nil {
+		return result, n, err
+	}
 	n = rows.CommandTag().RowsAffected()
 	return result, n, err
 }
 
+// QueryRows runs the select SQL of the route
+// NOTE the caller closes the rows
+func (s *servotron) QueryRows(ctx context.Context, tx *pgx.Tx, apiVersion string, routeName string, names []string, params []interface{}) (pgx.Rows, error) {
+	q, path, err := s.ReadSQL(apiVersion, "select", routeName+".sql")
+	if err != nil {
+		return nil, err
+	}
+	log.Println("QueryRows", "executing", path, params)
+	params, err = s.CoerceParams(ctx, *tx, string(q), names, params)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := (*tx).Query(ctx, string(q), params...)
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return rows, nil
+}
+
 func (s *servotron) ExecHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	routeName := mux.CurrentRoute(r).GetName()
-	apiVersion := r.Header.Get("Version")
-	pathTmpl := ""
+	apiVersion, err := s.ResolveVersion(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	crudDir := ""
 	switch r.Method {
 	case http.MethodPost:
-		pathTmpl = "%s/%s/insert/%s.sql"
+		crudDir = "insert"
 	case http.MethodPut:
-		pathTmpl = "%s/%s/update/%s.sql"
+		crudDir = "update"
 	case http.MethodDelete:
-		pathTmpl = "%s/%s/delete/%s.sql"
+		crudDir = "delete"
 	default:
 		log.Println("ExecHandler", "HTTP Method not recognized.")
 		w.WriteHeader(http.StatusNotImplemented)
 		return
 	}
-	path := fmt.Sprintf(pathTmpl, s.config.SQLRoot, apiVersion, routeName)
-	path = filepath.Clean(path)
-	q, err := os.ReadFile(path)
+	q, path, err := s.ReadSQL(apiVersion, crudDir, routeName+".sql")
 	if err != nil {
 		s.TeeError(w, err)
 		return
@@ -376,20 +628,19 @@ func (s *servotron) ExecHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println("ExecHandler", "processing", r.Method, routeName, params)
 	log.Println("ExecHandler", "executing", path, "with arguments", params)
-	tx, err := s.pool.Begin(context.Background())
+	tx, err := s.RequestTx(r)
 	if err != nil {
 		s.TeeError(w, err)
 		return
 	}
 	defer tx.Rollback(context.Background())
-	err = s.SetLocalParams(&tx, r)
+	ctx, cancel := s.DBContext(r)
+	defer cancel()
+	params, err = s.CoerceParams(ctx, tx, string(q), s.ParamNames(r), params)
 	if err != nil {
 		s.TeeError(w, err)
 		return
 	}
-	timeout := time.Duration(s.config.DBQueryTimeout) * time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
 	rows, err := tx.Query(ctx, string(q), params...)
 	defer rows.Close()
 	if err != nil {
@@ -402,13 +653,8 @@ func (s *servotron) ExecHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
-	// non-greedy capturing with (?U)
-	re := regexp.MustCompile(`(?U){(.*)}`)
-	groups := re.FindAllStringSubmatch(route.URLScheme, -1)
-	var pathVars []string
-	for _, val := range groups {
-		pathVars = append(pathVars, val[1])
-	}
+	pathVars := PathVars(route.URLScheme)
+	names := append(PathVars(route.URLScheme), route.QueryParams.Names()...)
 	params = params[:0]
 	var returnMap map[string]interface{}
 	var rawResult []json.RawMessage
@@ -420,6 +666,11 @@ func (s *servotron) ExecHandler(w http.ResponseWriter, r *http.Request) {
 		_ = copy(rawValue, rows.RawValues()[0])
 		rawValues = append(rawValues, rawValue)
 	}
+	err = rows.Err()
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
 	// NOTE RowsAffected is only known after all rows are read
 	n := rows.CommandTag().RowsAffected()
 	rows.Close()
@@ -434,10 +685,7 @@ func (s *servotron) ExecHandler(w http.ResponseWriter, r *http.Request) {
 		for _, p := range pathVars {
 			params = append(params, returnMap[p])
 		}
-		for i, q := range s.config.QueryParams[routeName] {
-			if i%2 != 0 {
-				continue
-			}
+		for _, q := range s.config.QueryParams[routeName].Names() {
 			str := pgtype.Text{String: "", Valid: false}
 			for k, v := range returnMap {
 				if q == k {
@@ -454,7 +702,7 @@ func (s *servotron) ExecHandler(w http.ResponseWriter, r *http.Request) {
 			params = append(params, str)
 		}
 		log.Println("ExecHandler", "returning", r.Method, routeName, params)
-		result, _, err := s.Query(&tx, "GET", apiVersion, routeName, params)
+		result, _, err := s.Query(ctx, &tx, "GET", apiVersion, routeName, names, params)
 		if err != nil {
 			s.TeeError(w, err)
 			return
@@ -463,7 +711,7 @@ func (s *servotron) ExecHandler(w http.ResponseWriter, r *http.Request) {
 		copy(c, result)
 		rawResult = append(rawResult, c)
 	}
-	err = tx.Commit(context.Background())
+	err = tx.Commit(ctx)
 	if err != nil {
 		s.TeeError(w, err)
 		return
@@ -493,134 +741,35 @@ func (s *servotron) ExecHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonResult)
 }
 
-// TODO refactor directory handling
-// TODO parse each statement from transaction script
-// TODO or get each statement from the ast
-// TODO execute each statement use SendBatch
-func (s *servotron) TransactionHandler(w http.ResponseWriter, r *http.Request) {
-	routeName := mux.CurrentRoute(r).GetName()
-	apiVersion := r.Header.Get("Version")
-	manifestFilePath := fmt.Sprintf(
-		"%s/%s/transaction/%s/manifest.json",
-		s.config.SQLRoot,
-		apiVersion,
-		routeName)
-	manifestFh, err := os.Open(manifestFilePath)
-	defer manifestFh.Close()
-	if err != nil {
-		log.Println("TransactionHandler", err)
-		if s.config.Debug {
-			w.Write(s.FormatErr(err.Error()))
-		}
-		return
-	}
-	scanner := bufio.NewScanner(manifestFh)
-	// TODO use ExtractParams
-	appUserAuth, err := s.GetAppUserAuth(r)
-	if err != nil {
-		log.Println("TransactionHandler", err)
-		if s.config.Debug {
-			w.Write(s.FormatErr(err.Error()))
-		}
-		return
-	}
-	arg, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Println("TransactionHandler", err)
-		if s.config.Debug {
-			w.Write(s.FormatErr(err.Error()))
-		}
-		return
-	}
-	tx, err := s.pool.Begin(context.Background())
-	if err != nil {
-		log.Println("TransactionHandler", err)
-		if s.config.Debug {
-			w.Write(s.FormatErr(err.Error()))
-		}
-		return
-	}
-	for scanner.Scan() {
-		fileName := scanner.Text()
-		path := fmt.Sprintf(
-			"%s/%s/transaction/%s/%s",
-			s.config.SQLRoot,
-			apiVersion,
-			routeName,
-			fileName)
-		path = filepath.Clean(path)
-		q, err := os.ReadFile(path)
-		timeout := time.Duration(s.config.DBQueryTimeout) * time.Second
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		_, err = tx.Exec(
-			ctx,
-			string(q),
-			appUserAuth,
-			arg)
-		if err != nil {
-			_ = tx.Rollback(context.Background())
-			log.Println("TransactionHandler", err)
-			if s.config.Debug {
-				w.Write(s.FormatErr(err.Error()))
-			}
-			return
-		}
-	}
-	err = tx.Commit(context.Background())
-	if err != nil {
-		log.Println("TransactionHandler", err)
-		if s.config.Debug {
-			w.Write(s.FormatErr(err.Error()))
-		}
-	}
-}
-
 func (s *servotron) ExtractParams(r *http.Request) ([]interface{}, error) {
 	var params []interface{}
 	pathTemplate, err := mux.CurrentRoute(r).GetPathTemplate()
 	if err != nil {
 		return params, err
 	}
-	// non-greedy capturing with (?U)
-	re := regexp.MustCompile(`(?U){(.*)}`)
-	groups := re.FindAllStringSubmatch(pathTemplate, -1)
-	var pathVars []string
-	for _, val := range groups {
-		pathVars = append(pathVars, val[1])
-	}
+	pathVars := PathVars(pathTemplate)
 	vars := mux.Vars(r)
 	for _, v := range pathVars {
 		params = append(params, vars[v])
 	}
 	if r.Method == http.MethodGet {
+		routeName := mux.CurrentRoute(r).GetName()
+		queryMap, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			return params, &ParamError{Name: "query", Type: "query string", Value: r.URL.RawQuery}
+		}
 		if s.config.QueryStringAsJSON {
-			queryMap, err := url.ParseQuery(r.URL.RawQuery)
+			j, err := s.config.QueryParams[routeName].ExtractJSON(queryMap)
 			if err != nil {
 				return params, err
 			}
-			atomMap := make(map[string]string)
-			for k, v := range queryMap {
-				atomMap[k] = v[0]
-			}
-			j, err := json.Marshal(atomMap)
+			params = append(params, j)
+		} else {
+			queryParams, err := s.config.QueryParams[routeName].Extract(queryMap)
 			if err != nil {
 				return params, err
 			}
-			params = append(params, string(j))
-		} else {
-			routeName := mux.CurrentRoute(r).GetName()
-			query := r.URL.Query()
-			for i, queryParam := range s.config.QueryParams[routeName] {
-				// TODO perform regex matching and validation
-				if i%2 == 0 {
-					str := pgtype.Text{String: query.Get(queryParam), Valid: true}
-					if str.String == "" {
-						str.Valid = false
-					}
-					params = append(params, str)
-				}
-			}
+			params = append(params, queryParams...)
 		}
 	}
 	if r.Method == http.MethodPost || r.Method == http.MethodPut {
@@ -638,79 +787,116 @@ func (s *servotron) ExtractParams(r *http.Request) ([]interface{}, error) {
 	return params, err
 }
 
+// appUserAuth is the app user auth of a request, with the payload of its JWT
+type appUserAuth struct {
+	value   string
+	payload []byte
+}
+
+// WithAppUserAuth verifies the app user auth and passes it in the request context
+// NOTE the token is verified once per request, rather than by each reader of the auth
+func (s *servotron) WithAppUserAuth(r *http.Request) (*http.Request, error) {
+	auth, err := s.ParseAppUserAuth(r)
+	if err != nil {
+		return r, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), appUserAuthContextKey, auth)), nil
+}
+
+// GetAppUserAuth returns the app user auth of the request
+// NOTE the auth verified by WithAppUserAuth is taken from the request context
 func (s *servotron) GetAppUserAuth(r *http.Request) (string, error) {
-	result := ""
+	if auth, ok := r.Context().Value(appUserAuthContextKey).(appUserAuth); ok {
+		return auth.value, nil
+	}
+	auth, err := s.ParseAppUserAuth(r)
+	return auth.value, err
+}
+
+// ParseAppUserAuth reads the app user auth from the request, and verifies and decodes its JWT
+func (s *servotron) ParseAppUserAuth(r *http.Request) (appUserAuth, error) {
+	var result appUserAuth
 	var err error
-	var segments []string
-	var byt []byte
 	if s.config.AppUserAuth["ParseFrom"] == "Header" {
-		result = r.Header.Get(s.config.AppUserAuth["Field"])
+		result.value = r.Header.Get(s.config.AppUserAuth["Field"])
 		if s.config.AppUserAuth["Type"] == "JWT" {
-			split := strings.Split(result, " ")
-			segments = strings.Split(split[len(split)-1], ".")
-			if len(segments) != 3 {
-				return result, fmt.Errorf(
-					"invalid JWT format. expected 3 segments, found %i",
-					len(segments))
-			}
-			byt, err = base64.RawURLEncoding.DecodeString(segments[1])
-			if err != nil {
-				return result, err
-			}
-			if s.config.AppUserAuth["Claim"] == "" {
-				return string(byt), err
-			}
-			mapped := make(map[string]interface{})
-			err = json.Unmarshal(byt, &mapped)
-			if err != nil {
-				return result, err
-			}
-			if configClaim, ok := s.config.AppUserAuth["Claim"]; ok {
-				if claim, ok := mapped[configClaim]; ok {
-					result = claim.(string)
-				}
-			}
+			split := strings.Split(result.value, " ")
+			result.value, result.payload, err = s.ParseJWT(split[len(split)-1])
+			return result, err
 		}
 	}
 	if s.config.AppUserAuth["ParseFrom"] == "Cookie" {
 		var userCookie *http.Cookie
 		if s.config.AppUserAuth["Name"] == "" {
-			return s.GetJSONFromCookies(r.Cookies())
+			result.value, err = s.GetJSONFromCookies(r.Cookies())
+			return result, err
 		}
 		userCookie, err = r.Cookie(s.config.AppUserAuth["Name"])
 		if err != nil {
+			if s.jwtVerifier != nil {
+				return result, fmt.Errorf("%w: %s", ErrInvalidToken, err)
+			}
 			return result, err
 		}
-		result = userCookie.Value
+		result.value = userCookie.Value
 		if s.config.AppUserAuth["Type"] == "JWT" {
-			segments = strings.Split(result, ".")
-			if len(segments) != 3 {
-				return result, fmt.Errorf(
-					"invalid JWT format. expected 3 segments, found %d",
-					len(segments))
-			}
-			byt, err = base64.RawURLEncoding.DecodeString(segments[1])
-			if err != nil {
-				return result, err
-			}
-			if s.config.AppUserAuth["Claim"] == "" {
-				return string(byt), err
-			}
-			mapped := make(map[string]interface{})
-			err = json.Unmarshal(byt, &mapped)
-			if err != nil {
-				return result, err
-			}
-			if configClaim, ok := s.config.AppUserAuth["Claim"]; ok {
-				if claim, ok := mapped[configClaim]; ok {
-					result = claim.(string)
-				}
-			}
+			result.value, result.payload, err = s.ParseJWT(result.value)
+			return result, err
 		}
 	}
 	return result, err
 }
 
+// ParseJWT returns the payload, or the configured claim, of the token, and the payload
+// NOTE the signature and registered claims are checked if Verify is set
+func (s *servotron) ParseJWT(token string) (string, []byte, error) {
+	byt, err := s.JWTPayload(token)
+	if err != nil {
+		return token, byt, err
+	}
+	if s.config.AppUserAuth["Claim"] == "" {
+		return string(byt), byt, err
+	}
+	claim, ok, err := JWTClaim(byt, s.config.AppUserAuth["Claim"])
+	if err != nil || !ok {
+		return token, byt, err
+	}
+	return claim, byt, err
+}
+
+// JWTPayload returns the payload of the token
+// NOTE the signature and registered claims are checked if Verify is set
+func (s *servotron) JWTPayload(token string) ([]byte, error) {
+	if s.jwtVerifier != nil {
+		return s.jwtVerifier.Verify(token)
+	}
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf(
+			"invalid JWT format. expected 3 segments, found %d",
+			len(segments))
+	}
+	return base64.RawURLEncoding.DecodeString(segments[1])
+}
+
+// JWTClaim returns the named claim of the payload, non string claims as JSON
+func JWTClaim(payload []byte, name string) (string, bool, error) {
+	mapped := make(map[string]interface{})
+	err := json.Unmarshal(payload, &mapped)
+	if err != nil {
+		return "", false, err
+	}
+	claim, ok := mapped[name]
+	if !ok {
+		return "", false, nil
+	}
+	if str, ok := claim.(string); ok {
+		return str, true, nil
+	}
+	byt, err := json.Marshal(claim)
+	return string(byt), true, err
+}
+
 func (s *servotron) GetMapFromCookies(cookies []*http.Cookie) map[string]string {
 	result := make(map[string]string)
 	for _, cookie := range cookies {
@@ -724,45 +910,116 @@ func (s *servotron) GetJSONFromCookies(cookies []*http.Cookie) (string, error) {
 	return string(byt), err
 }
 
-func (s *servotron) SetLocalParams(tx *pgx.Tx, r *http.Request) error {
-	appUserAuth, err := s.GetAppUserAuth(r)
+func (s *servotron) SetLocalParams(ctx context.Context, tx *pgx.Tx, r *http.Request) error {
+	batch, names, err := s.LocalParamsBatch(r)
 	if err != nil {
 		return err
 	}
-	q := "select set_config('app_user.auth',$1,true)"
-	_, err = (*tx).Exec(context.Background(), q, appUserAuth)
+	return s.SendLocalParams(ctx, *tx, batch, names)
+}
+
+// SendLocalParams sends the batch queued by LocalParamsBatch and reads its results
+func (s *servotron) SendLocalParams(ctx context.Context, tx pgx.Tx, batch *pgx.Batch, names []string) error {
+	br := tx.SendBatch(ctx, batch)
+	err := s.ReadLocalParams(br, names)
 	if err != nil {
+		br.Close()
 		return err
 	}
+	return br.Close()
+}
+
+// LocalParamsBatch queues the set_config calls for the request
+// NOTE AppUserLocalParams queries are inlined as subqueries to avoid a round trip each
+func (s *servotron) LocalParamsBatch(r *http.Request) (*pgx.Batch, []string, error) {
+	batch := &pgx.Batch{}
+	var names []string
+	appUserAuth, err := s.GetAppUserAuth(r)
+	if err != nil {
+		return batch, names, err
+	}
+	q := "select set_config($1,$2,true)"
+	// NOTE route settings are set first, so they apply to the local params queries too
+	route, _ := RequestRoute(r)
+	var settings []string
+	for k := range route.Settings {
+		settings = append(settings, k)
+	}
+	sort.Strings(settings)
+	for _, k := range settings {
+		batch.Queue(q, k, route.Settings[k])
+		names = append(names, k)
+	}
+	batch.Queue(q, "app_user.auth", appUserAuth)
+	names = append(names, "app_user.auth")
 	appUserCookies, err := s.GetJSONFromCookies(r.Cookies())
-	q = "select set_config('app_user.cookies',$1,true)"
-	_, err = (*tx).Exec(context.Background(), q, appUserCookies)
 	if err != nil {
-		return err
+		return batch, names, err
+	}
+	batch.Queue(q, "app_user.cookies", appUserCookies)
+	names = append(names, "app_user.cookies")
+	apiVersion, err := s.ResolveVersion(r)
+	if err != nil {
+		return batch, names, err
+	}
+	requestNames, requestValues, err := s.RequestSettings(r, apiVersion)
+	if err != nil {
+		return batch, names, err
+	}
+	for i, name := range requestNames {
+		batch.Queue(q, name, requestValues[i])
+		names = append(names, name)
 	}
-	// get system user for file path expansion
-	var result string
-	var byt []byte
-	tmpl := "%s/%s/select/%s"
-	apiVersion := r.Header.Get("Version")
-	for k, v := range s.config.AppUserLocalParams {
-		f := fmt.Sprintf(tmpl, s.config.SQLRoot, apiVersion, v)
-		byt, err = os.ReadFile(filepath.Clean(f))
+	// NOTE sorted for a deterministic order of evaluation
+	var keys []string
+	for k := range s.config.AppUserLocalParams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		byt, _, err := s.ReadSQL(apiVersion, "select", s.config.AppUserLocalParams[k])
 		if err != nil {
-			return err
+			return batch, names, err
 		}
-		err := (*tx).QueryRow(context.Background(), string(byt)).Scan(&result)
+		sub, err := TrimStatement(string(byt))
 		if err != nil {
-			return err
+			return batch, names, fmt.Errorf("local param %s: %w", k, err)
+		}
+		// NOTE selected from rather than a scalar subquery, so a query without rows has no result and fails the request
+		batch.Queue(fmt.Sprintf("select set_config($1,local_param.value::text,true) from (\n%s\n) as local_param(value) limit 1", sub), "app_user."+k)
+		names = append(names, "app_user."+k)
+	}
+	// NOTE the role is set after the local params, so the authorization and route SQL run as the role
+	if 0 < len(s.config.AppUserRole) {
+		err = s.QueueRole(batch, r)
+		if err != nil {
+			return batch, names, err
+		}
+		names = append(names, "role")
+	}
+	return batch, names, err
+}
+
+// ReadLocalParams reads the results of the set_config calls queued by LocalParamsBatch
+func (s *servotron) ReadLocalParams(br pgx.BatchResults, names []string) error {
+	for _, name := range names {
+		var result pgtype.Text
+		err := br.QueryRow().Scan(&result)
+		if name == "role" && errors.Is(err, pgx.ErrNoRows) {
+			return ErrRoleNotAllowed
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("local param %s returned no row: %w", name, err)
 		}
-		log.Println("SetLocalParameters", k, result)
-		q = fmt.Sprintf("select set_config('app_user.%s',$1,true)", k)
-		_, err = (*tx).Exec(context.Background(), q, result)
 		if err != nil {
 			return err
 		}
+		// NOTE auth, cookies and headers are not logged
+		if name != "app_user.auth" && name != "app_user.cookies" && name != "request.headers" {
+			log.Println("SetLocalParams", name, result.String)
+		}
 	}
-	return err
+	return nil
 }
 
 // NOTE for server side includes and rendering of static content based on user info
@@ -772,37 +1029,34 @@ func (s *servotron) SetLocalParams(tx *pgx.Tx, r *http.Request) error {
 // NOTE multiple template dirs and overlays are possible via template config
 func (s *servotron) HandleTemplateReq(templateDir string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		apiVersion := r.Header.Get("Version")
+		apiVersion, err := s.ResolveVersion(r)
+		if err != nil {
+			s.TeeError(w, err)
+			return
+		}
 		params, err := s.ExtractParams(r)
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
-		var result []byte
-		tmpl := "%s/%s/select/%s"
-		infoFilePath := fmt.Sprintf(
-			tmpl,
-			s.config.SQLRoot,
-			apiVersion,
-			s.config.AppUserLocalParams["info"])
-		q, err := os.ReadFile(filepath.Clean(infoFilePath))
+		r, err = s.WithAppUserAuth(r)
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
-		tx, err := s.pool.Begin(context.Background())
+		var result []byte
+		q, _, err := s.ReadSQL(apiVersion, "select", s.config.AppUserLocalParams["info"])
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
-		defer tx.Rollback(context.Background())
-		err = s.SetLocalParams(&tx, r)
+		tx, err := s.RequestTx(r)
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
-		timeout := time.Duration(s.config.DBQueryTimeout) * time.Second
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer tx.Rollback(context.Background())
+		ctx, cancel := s.DBContext(r)
 		defer cancel()
 		rows, err := tx.Query(ctx, string(q), params...)
 		if err != nil {
@@ -813,25 +1067,19 @@ func (s *servotron) HandleTemplateReq(templateDir string) func(w http.ResponseWr
 		for rows.Next() {
 			result = rows.RawValues()[0]
 		}
-		err = tx.Commit(context.Background())
+		err = rows.Err()
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
-		log.Println("HandleTemplateRequest", string(result))
-		var appUser map[string]interface{}
-		err = json.Unmarshal(result, &appUser)
+		err = tx.Commit(ctx)
 		if err != nil {
 			s.TeeError(w, err)
 			return
 		}
-		funcMap := template.FuncMap{}
-		funcMap["Title"] = strings.Title
-		baseTmpl := templateDir + "/base.go.html"
-		baseTmpl = filepath.Clean(baseTmpl)
-		base, err := template.New("base.go.html").
-			Funcs(funcMap).
-			ParseFiles(baseTmpl)
+		log.Println("HandleTemplateRequest", string(result))
+		var appUser map[string]interface{}
+		err = json.Unmarshal(result, &appUser)
 		if err != nil {
 			s.TeeError(w, err)
 			return
@@ -841,7 +1089,9 @@ func (s *servotron) HandleTemplateReq(templateDir string) func(w http.ResponseWr
 			templateDir,
 			path.Clean(r.URL.EscapedPath()))
 		reqTmpl = filepath.Clean(reqTmpl)
-		overlay, err := template.Must(base.Clone()).ParseFiles(reqTmpl)
+		overlay, err := s.files.Template(reqTmpl, func() (*template.Template, error) {
+			return s.ParseTemplate(templateDir, reqTmpl)
+		})
 		if err != nil {
 			s.TeeError(w, err)
 			return
@@ -854,14 +1104,49 @@ func (s *servotron) HandleTemplateReq(templateDir string) func(w http.ResponseWr
 	}
 }
 
+// ParseTemplate overlays the request template on the base template of the template dir
+func (s *servotron) ParseTemplate(templateDir string, reqTmpl string) (*template.Template, error) {
+	funcMap := template.FuncMap{}
+	funcMap["Title"] = strings.Title
+	baseTmpl := filepath.Clean(templateDir + "/base.go.html")
+	byt, err := s.files.ReadFile(baseTmpl)
+	if err != nil {
+		return nil, err
+	}
+	base, err := template.New("base.go.html").
+		Funcs(funcMap).
+		Parse(string(byt))
+	if err != nil {
+		return nil, err
+	}
+	byt, err = s.files.ReadRequestFile(reqTmpl)
+	if err != nil {
+		return nil, err
+	}
+	overlay, err := base.Clone()
+	if err != nil {
+		return nil, err
+	}
+	_, err = overlay.New(filepath.Base(reqTmpl)).Parse(string(byt))
+	if err != nil {
+		return nil, err
+	}
+	return overlay, nil
+}
+
 func (s *servotron) FormatErr(err string) []byte {
 	return []byte(fmt.Sprintf(`{"error":%q}`, err))
 }
 
 func (s *servotron) TeeError(w http.ResponseWriter, err error) {
-	log.Println("TeeError", err)
-	w.WriteHeader(http.StatusInternalServerError)
-	if s.config.Debug {
-		w.Write(s.FormatErr(err.Error()))
+	// NOTE the error decides whether a buffered request is retried
+	if response, ok := w.(*bufferedResponse); ok {
+		response.err = err
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Println("TeeError", "request canceled by client", err)
+	} else {
+		log.Println("TeeError", err)
 	}
+	s.WriteProblem(w, err)
 }
@@ -0,0 +1,197 @@
+package servotron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var uuidPattern = regexp.MustCompile(`^(?i)\{?[0-9a-f]{8}-?[0-9a-f]{4}-?[0-9a-f]{4}-?[0-9a-f]{4}-?[0-9a-f]{12}\}?$`)
+
+// ParamError is returned when a request param violates its query param spec
+// or cannot be coerced to the type of its SQL parameter
+type ParamError struct {
+	Name   string
+	Type   string
+	Value  string
+	Reason string
+}
+
+func (e *ParamError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("parameter %q %s", e.Name, e.Reason)
+	}
+	return fmt.Sprintf("invalid %s value for parameter %q: %q", e.Type, e.Name, e.Value)
+}
+
+// statementKey identifies described SQL
+// NOTE the same SQL can have other parameter types in another database or under another search_path
+type statementKey struct {
+	database   string
+	searchPath string
+	q          string
+}
+
+// statementCache holds the parameter OIDs of described SQL
+// NOTE keyed by the SQL text, so a changed file is described again
+type statementCache struct {
+	mu   sync.RWMutex
+	oids map[statementKey][]uint32
+}
+
+func NewStatementCache() *statementCache {
+	return &statementCache{oids: make(map[statementKey][]uint32)}
+}
+
+func (c *statementCache) Get(key statementKey) ([]uint32, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	oids, ok := c.oids[key]
+	return oids, ok
+}
+
+func (c *statementCache) Set(key statementKey, oids []uint32) {
+	c.mu.Lock()
+	c.oids[key] = oids
+	c.mu.Unlock()
+}
+
+func (c *statementCache) Reload() {
+	c.mu.Lock()
+	c.oids = make(map[statementKey][]uint32)
+	c.mu.Unlock()
+}
+
+// StatementKey returns the cache key of the SQL on the connection
+// NOTE the search_path is the setting of the route in the context, if any
+func StatementKey(ctx context.Context, conn *pgx.Conn, q string) statementKey {
+	cfg := conn.Config()
+	result := statementKey{
+		database: fmt.Sprintf("%s:%d/%s", cfg.Host, cfg.Port, cfg.Database),
+		q:        q,
+	}
+	route, _ := ctx.Value(routeContextKey).(Route)
+	for k, v := range route.Settings {
+		if strings.EqualFold(k, "search_path") {
+			result.searchPath = v
+		}
+	}
+	return result
+}
+
+// ParamOIDs returns the parameter OIDs of the SQL, describing it on the server on a cache miss
+// NOTE the unnamed statement is used so nothing is left prepared on the connection
+// NOTE requests describe SQL in the request transaction, after the local params and the role are set
+func (s *servotron) ParamOIDs(ctx context.Context, conn *pgx.Conn, q string) ([]uint32, error) {
+	key := StatementKey(ctx, conn, q)
+	if oids, ok := s.statements.Get(key); ok {
+		return oids, nil
+	}
+	sd, err := conn.Prepare(ctx, "", q)
+	if err != nil {
+		return nil, err
+	}
+	s.statements.Set(key, sd.ParamOIDs)
+	return sd.ParamOIDs, nil
+}
+
+// ParamNames returns the names of the params returned by ExtractParams, in order
+func (s *servotron) ParamNames(r *http.Request) []string {
+	pathTemplate, _ := mux.CurrentRoute(r).GetPathTemplate()
+	result := PathVars(pathTemplate)
+	if r.Method == http.MethodGet {
+		if s.config.QueryStringAsJSON {
+			result = append(result, "query")
+		} else {
+			routeName := mux.CurrentRoute(r).GetName()
+			result = append(result, s.config.QueryParams[routeName].Names()...)
+		}
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		result = append(result, "body")
+	}
+	return result
+}
+
+// CoerceParams validates the request params against the parameter types of the SQL
+// NOTE numeric and boolean params are converted, other params are only validated
+func (s *servotron) CoerceParams(ctx context.Context, tx pgx.Tx, q string, names []string, params []interface{}) ([]interface{}, error) {
+	oids, err := s.ParamOIDs(ctx, tx.Conn(), q)
+	if err != nil {
+		return params, err
+	}
+	result := make([]interface{}, len(params))
+	copy(result, params)
+	for i, param := range params {
+		if len(oids) <= i {
+			break
+		}
+		var value string
+		switch p := param.(type) {
+		case string:
+			value = p
+		case pgtype.Text:
+			if !p.Valid {
+				continue
+			}
+			value = p.String
+		default:
+			continue
+		}
+		name := fmt.Sprintf("$%d", i+1)
+		if i < len(names) {
+			name = names[i]
+		}
+		coerced, typeName, ok := CoerceParam(oids[i], value)
+		if !ok {
+			return params, &ParamError{Name: name, Type: typeName, Value: value}
+		}
+		result[i] = coerced
+	}
+	return result, nil
+}
+
+// CoerceParam converts a text value to the Go type of the OID
+// NOTE types without a conversion are passed through as text
+func CoerceParam(oid uint32, value string) (interface{}, string, bool) {
+	switch oid {
+	case pgtype.Int2OID:
+		n, err := strconv.ParseInt(value, 10, 16)
+		return n, "smallint", err == nil
+	case pgtype.Int4OID:
+		n, err := strconv.ParseInt(value, 10, 32)
+		return n, "integer", err == nil
+	case pgtype.Int8OID:
+		n, err := strconv.ParseInt(value, 10, 64)
+		return n, "bigint", err == nil
+	case pgtype.Float4OID, pgtype.Float8OID:
+		f, err := strconv.ParseFloat(value, 64)
+		return f, "double precision", err == nil
+	case pgtype.NumericOID:
+		_, ok := new(big.Float).SetString(value)
+		return value, "numeric", ok || strings.EqualFold(value, "NaN")
+	case pgtype.BoolOID:
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, "boolean", true
+		case "f", "false", "n", "no", "off", "0":
+			return false, "boolean", true
+		}
+		return value, "boolean", false
+	case pgtype.UUIDOID:
+		return value, "uuid", uuidPattern.MatchString(value)
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		return value, "json", json.Valid([]byte(value))
+	}
+	return value, "text", true
+}
@@ -0,0 +1,279 @@
+package servotron
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// NOTE if manifest json changes, then the manifest struct must change
+// NOTE step params reference request params by name (path vars, query params, body),
+// the app user auth (auth), or the result of an earlier step (steps.[name] or steps.[name].[field])
+type Manifest struct {
+	Steps []TransactionStep
+}
+
+type TransactionStep struct {
+	Name   string
+	File   string
+	Params []string
+	Output bool
+}
+
+// ParseManifest parses a JSON manifest
+// NOTE a manifest of one file name per line is also accepted, each file receiving the auth and body
+func ParseManifest(b []byte) (Manifest, error) {
+	var result Manifest
+	trimmed := bytes.TrimSpace(b)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		err := json.Unmarshal(trimmed, &result)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+		for scanner.Scan() {
+			fileName := strings.TrimSpace(scanner.Text())
+			if fileName == "" {
+				continue
+			}
+			result.Steps = append(result.Steps, TransactionStep{
+				Name:   strings.TrimSuffix(fileName, ".sql"),
+				File:   fileName,
+				Params: []string{"auth", "body"},
+			})
+		}
+	}
+	seen := make(map[string]bool)
+	for i, step := range result.Steps {
+		if step.Name == "" || step.File == "" {
+			return result, fmt.Errorf("manifest step %d: missing Name or File", i)
+		}
+		for _, param := range step.Params {
+			if !strings.HasPrefix(param, "steps.") {
+				continue
+			}
+			ref := strings.SplitN(strings.TrimPrefix(param, "steps."), ".", 2)[0]
+			if !seen[ref] {
+				return result, fmt.Errorf("manifest step %s: param %s does not reference an earlier step", step.Name, param)
+			}
+		}
+		if seen[step.Name] {
+			return result, fmt.Errorf("manifest step %s: duplicate step name", step.Name)
+		}
+		seen[step.Name] = true
+	}
+	return result, nil
+}
+
+// TransactionHandler executes the manifest steps in order in the request transaction
+// NOTE the response is a JSON object of the Output step results keyed by step name
+func (s *servotron) TransactionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	routeName := mux.CurrentRoute(r).GetName()
+	apiVersion, err := s.ResolveVersion(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	b, _, err := s.ReadSQL(apiVersion, "transaction", routeName, "manifest.json")
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	manifest, err := ParseManifest(b)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	requestParams, err := s.RequestParams(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	log.Println("TransactionHandler", "processing", r.Method, routeName)
+	tx, err := s.RequestTx(r)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+	ctx, cancel := s.DBContext(r)
+	defer cancel()
+	results := make(map[string]json.RawMessage)
+	output := make(map[string]json.RawMessage)
+	for _, step := range manifest.Steps {
+		q, path, err := s.ReadSQL(apiVersion, "transaction", routeName, step.File)
+		if err != nil {
+			s.TeeError(w, err)
+			return
+		}
+		var args []interface{}
+		for _, param := range step.Params {
+			arg, err := s.StepArg(param, requestParams, results)
+			if err != nil {
+				s.TeeError(w, err)
+				return
+			}
+			args = append(args, arg)
+		}
+		log.Println("TransactionHandler", "executing", path, "with arguments", args)
+		result, err := s.ExecStep(ctx, tx, string(q), step.Params, args)
+		if err != nil {
+			s.TeeError(w, err)
+			return
+		}
+		results[step.Name] = result
+		if step.Output {
+			output[step.Name] = result
+		}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	j, err := json.Marshal(output)
+	if err != nil {
+		s.TeeError(w, err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(j)
+}
+
+// RequestParams maps the names of the request params to their values
+// NOTE the body is read regardless of content type
+func (s *servotron) RequestParams(r *http.Request) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	params, err := s.ExtractParams(r)
+	if err != nil {
+		return result, err
+	}
+	for i, name := range s.ParamNames(r) {
+		if i < len(params) {
+			result[name] = params[i]
+		}
+	}
+	if _, ok := result["body"]; !ok && r.Body != nil {
+		arg, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(arg))
+		if err != nil {
+			return result, err
+		}
+		result["body"] = string(arg)
+	}
+	if _, ok := result["auth"]; !ok {
+		appUserAuth, err := s.GetAppUserAuth(r)
+		if err != nil {
+			return result, err
+		}
+		result["auth"] = appUserAuth
+	}
+	return result, nil
+}
+
+// StepArg resolves a manifest step param to its argument
+func (s *servotron) StepArg(param string, requestParams map[string]interface{}, results map[string]json.RawMessage) (interface{}, error) {
+	if !strings.HasPrefix(param, "steps.") {
+		arg, ok := requestParams[param]
+		if !ok {
+			return nil, fmt.Errorf("unknown transaction param %q", param)
+		}
+		return arg, nil
+	}
+	ref := strings.SplitN(strings.TrimPrefix(param, "steps."), ".", 2)
+	result, ok := results[ref[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown transaction step %q", ref[0])
+	}
+	if len(ref) == 1 {
+		return JSONArg(result)
+	}
+	var value interface{}
+	err := json.Unmarshal(result, &value)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE a field of an array result is the array of the field of each element
+	switch v := value.(type) {
+	case map[string]interface{}:
+		value = v[ref[1]]
+	case []interface{}:
+		var fields []interface{}
+		for _, elem := range v {
+			if m, ok := elem.(map[string]interface{}); ok {
+				fields = append(fields, m[ref[1]])
+			}
+		}
+		value = fields
+	default:
+		return nil, fmt.Errorf("transaction step %q result has no field %q", ref[0], ref[1])
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return JSONArg(b)
+}
+
+// JSONArg converts a JSON value to a text argument
+// NOTE strings are unquoted and null is NULL
+func JSONArg(b json.RawMessage) (interface{}, error) {
+	var str string
+	switch {
+	case len(b) == 0 || string(b) == "null":
+		return pgtype.Text{String: "", Valid: false}, nil
+	case json.Unmarshal(b, &str) == nil:
+		return str, nil
+	}
+	return string(b), nil
+}
+
+// ExecStep executes a manifest step and returns its result as JSON
+// NOTE a single row is the value of its first column, multiple rows are an array and no rows are null
+func (s *servotron) ExecStep(ctx context.Context, tx pgx.Tx, q string, names []string, args []interface{}) (json.RawMessage, error) {
+	args, err := s.CoerceParams(ctx, tx, q, names, args)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []interface{}
+	for rows.Next() {
+		rowValues, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		if 0 < len(rowValues) {
+			values = append(values, rowValues[0])
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	switch len(values) {
+	case 0:
+		return json.RawMessage("null"), nil
+	case 1:
+		return json.Marshal(values[0])
+	}
+	return json.Marshal(values)
+}
@@ -0,0 +1,487 @@
+package servotron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// non-greedy capturing with (?U)
+var pathVarPattern = regexp.MustCompile(`(?U){(.*)}`)
+
+// settingPattern matches setting names such as work_mem or custom.name
+var settingPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// reservedSettings cannot be set by routes
+var reservedSettings = []string{"app_user.", "request.", "role", "session_authorization"}
+
+var dollarQuotePattern = regexp.MustCompile(`^\$[A-Za-z_][A-Za-z0-9_]*\$|^\$\$`)
+
+// RouteReport lists the problems found validating routes against SQLRoot
+type RouteReport struct {
+	Valid    bool
+	Problems []RouteProblem
+}
+
+type RouteProblem struct {
+	Version string `json:",omitempty"`
+	Route   string
+	Type    string
+	File    string `json:",omitempty"`
+	Problem string
+}
+
+func (r *RouteReport) Error() string {
+	var problems []string
+	for _, p := range r.Problems {
+		problems = append(problems, p.String())
+	}
+	return fmt.Sprintf("invalid routes: %s", strings.Join(problems, "; "))
+}
+
+func (p RouteProblem) String() string {
+	result := fmt.Sprintf("%s route %s", p.Type, p.Route)
+	if p.Version != "" {
+		result = fmt.Sprintf("version %s: %s", p.Version, result)
+	}
+	if p.File != "" {
+		result = fmt.Sprintf("%s: %s", result, p.File)
+	}
+	return fmt.Sprintf("%s: %s", result, p.Problem)
+}
+
+type requiredFile struct {
+	elem []string
+	// NOTE a negative count is not checked
+	params int
+}
+
+// PathVars returns the path variable names of a URL scheme
+// NOTE mux patterns such as {id:[0-9]+} are stripped
+func PathVars(urlScheme string) []string {
+	var result []string
+	for _, val := range pathVarPattern.FindAllStringSubmatch(urlScheme, -1) {
+		result = append(result, strings.SplitN(val[1], ":", 2)[0])
+	}
+	return result
+}
+
+// CountPlaceholders returns the highest $n placeholder in the SQL
+// NOTE comments, quoted strings, quoted identifiers and dollar quoted strings are skipped
+func CountPlaceholders(q string) int {
+	result := 0
+	for i := 0; i < len(q); i++ {
+		switch {
+		case strings.HasPrefix(q[i:], "--"):
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				return result
+			}
+			i += end
+		case strings.HasPrefix(q[i:], "/*"):
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				return result
+			}
+			i += end + 3
+		case q[i] == '\'' || q[i] == '"':
+			end := strings.IndexByte(q[i+1:], q[i])
+			if end < 0 {
+				return result
+			}
+			i += end + 1
+		case q[i] == '$':
+			if tag := dollarQuotePattern.FindString(q[i:]); tag != "" {
+				end := strings.Index(q[i+len(tag):], tag)
+				if end < 0 {
+					return result
+				}
+				i += len(tag) + end + len(tag) - 1
+				continue
+			}
+			j := i + 1
+			for j < len(q) && '0' <= q[j] && q[j] <= '9' {
+				j++
+			}
+			if n, err := strconv.Atoi(q[i+1 : j]); err == nil && result < n {
+				result = n
+			}
+			i = j - 1
+		}
+	}
+	return result
+}
+
+// ErrMultipleStatements is returned for SQL inlined as a subquery with more than one statement
+var ErrMultipleStatements = errors.New("expected a single statement")
+
+// TrimStatement returns the SQL without trailing semicolons, comments and whitespace
+// NOTE comments, quoted strings, quoted identifiers and dollar quoted strings are skipped, as in CountPlaceholders
+func TrimStatement(q string) (string, error) {
+	end := 0
+	semicolon := false
+	for i := 0; i < len(q); i++ {
+		switch {
+		case strings.HasPrefix(q[i:], "--"):
+			n := strings.IndexByte(q[i:], '\n')
+			if n < 0 {
+				n = len(q) - i
+			}
+			i += n - 1
+			continue
+		case strings.HasPrefix(q[i:], "/*"):
+			n := strings.Index(q[i+2:], "*/")
+			if n < 0 {
+				n = len(q) - i - 3
+			}
+			i += n + 3
+			continue
+		case q[i] == ';':
+			semicolon = true
+			continue
+		case unicode.IsSpace(rune(q[i])):
+			continue
+		}
+		if semicolon {
+			return q, ErrMultipleStatements
+		}
+		switch {
+		case q[i] == '\'' || q[i] == '"':
+			n := strings.IndexByte(q[i+1:], q[i])
+			if n < 0 {
+				n = len(q) - i - 2
+			}
+			i += n + 1
+		case q[i] == '$':
+			if tag := dollarQuotePattern.FindString(q[i:]); tag != "" {
+				n := strings.Index(q[i+len(tag):], tag)
+				if n < 0 {
+					n = len(q) - i - 2*len(tag)
+				}
+				i += n + 2*len(tag) - 1
+			}
+		}
+		end = i + 1
+	}
+	return q[:end], nil
+}
+
+// RequiredSQLFiles returns the SQL files, relative to the version dir, each route type depends on
+func (s *servotron) RequiredSQLFiles(r Route) []requiredFile {
+	var result []requiredFile
+	pathVars := len(PathVars(r.URLScheme))
+	queryParams := len(r.QueryParams)
+	if s.config.QueryStringAsJSON {
+		queryParams = 1
+	}
+	switch r.Type {
+	case "service":
+		result = append(result, requiredFile{[]string{"auth", "service", r.Name + ".sql"}, -1})
+	case "read":
+		result = append(result,
+			requiredFile{[]string{"select", r.Name + ".sql"}, pathVars + queryParams},
+			requiredFile{[]string{"auth", "select", r.Name + ".sql"}, pathVars + queryParams})
+	case "export":
+		result = append(result,
+			requiredFile{[]string{"export", r.Name + ".sql"}, pathVars + queryParams},
+			requiredFile{[]string{"auth", "export", r.Name + ".sql"}, pathVars + queryParams})
+	case "create", "update":
+		crudDir := "insert"
+		if r.Type == "update" {
+			crudDir = "update"
+		}
+		// NOTE the request body is the last argument
+		// NOTE the select returns the created or updated resource and is checked with the read route
+		result = append(result,
+			requiredFile{[]string{crudDir, r.Name + ".sql"}, pathVars + 1},
+			requiredFile{[]string{"auth", crudDir, r.Name + ".sql"}, pathVars + 1},
+			requiredFile{[]string{"select", r.Name + ".sql"}, -1})
+	case "delete":
+		result = append(result,
+			requiredFile{[]string{"delete", r.Name + ".sql"}, pathVars},
+			requiredFile{[]string{"auth", "delete", r.Name + ".sql"}, pathVars})
+	case "transaction":
+		result = append(result, requiredFile{[]string{"transaction", r.Name, "manifest.json"}, -1})
+		// NOTE each method is authorized by its own auth SQL, with the request body but for DELETE
+		for _, method := range r.TransactionMethods() {
+			crudDir, ok := transactionMethods[method]
+			if !ok {
+				continue
+			}
+			params := pathVars + 1
+			if method == http.MethodDelete {
+				params = pathVars
+			}
+			result = append(result, requiredFile{[]string{"auth", crudDir, r.Name + ".sql"}, params})
+		}
+	}
+	return result
+}
+
+// ValidateRoutes checks that every declared version has the SQL files each route depends on
+// NOTE the files read are held in the file cache
+func (s *servotron) ValidateRoutes(routes []Route) *RouteReport {
+	report := &RouteReport{}
+	seen := make(map[string]bool)
+	for _, r := range routes {
+		switch r.Type {
+		case "service", "read", "export", "create", "update", "delete", "transaction":
+		default:
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "unknown route type"})
+			continue
+		}
+		if r.Name == "" {
+			report.Add(RouteProblem{Type: r.Type, Problem: "missing route name"})
+		}
+		if r.URLScheme == "" {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "missing URLScheme"})
+		}
+		if seen[r.Type+" "+r.Name] {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "duplicate route"})
+		}
+		seen[r.Type+" "+r.Name] = true
+		if _, ok := s.config.Databases[r.Database]; r.Database != "" && !ok {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: fmt.Sprintf("unknown database %q", r.Database)})
+		}
+		if r.Type == "service" && r.ServiceURL == "" {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "missing ServiceURL"})
+		}
+		if r.Timeout != "" {
+			timeout, err := time.ParseDuration(r.Timeout)
+			if err != nil || timeout <= 0 {
+				report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: fmt.Sprintf("invalid Timeout %q", r.Timeout)})
+			}
+		}
+		for _, method := range r.Methods {
+			if _, ok := transactionMethods[method]; !ok || r.Type != "transaction" {
+				report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: fmt.Sprintf("invalid method %q, Methods are POST, PUT or DELETE of transaction routes", method)})
+			}
+		}
+		if r.RowSet && r.Type != "read" {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "RowSet is only valid for read routes"})
+		}
+		if r.Stream && r.Type != "read" {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "Stream is only valid for read routes"})
+		}
+		if r.MaxRows < 0 || r.MaxBytes < 0 {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "MaxRows and MaxBytes must not be negative"})
+		}
+		if 0 < r.MaxRows && !r.RowSet && !r.Stream {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "MaxRows requires RowSet or Stream"})
+		}
+		if 0 < r.MaxBytes && !r.RowSet && !r.Stream && r.Type != "export" {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: "MaxBytes requires RowSet, Stream or an export route"})
+		}
+		if !IsIsolationLevel(r.IsolationLevel) {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: fmt.Sprintf("invalid IsolationLevel %q", r.IsolationLevel)})
+		}
+		for k := range r.Settings {
+			err := CheckSetting(k)
+			if err != nil {
+				report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: err.Error()})
+			}
+		}
+		for _, p := range r.QueryParams {
+			err := p.Check()
+			if err != nil {
+				report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: err.Error()})
+			}
+		}
+	}
+	// NOTE SQL is described on the server if the database is available
+	conns := make(map[string]*pgx.Conn)
+	for name, db := range s.databases {
+		if !db.available.Load() {
+			log.Println("ValidateRoutes", "skipping SQL description of unavailable database", name)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.DBQueryTimeout)*time.Second)
+		pooled, err := db.pool.Acquire(ctx)
+		cancel()
+		if err != nil {
+			log.Println("ValidateRoutes", "skipping SQL description of database", name, err)
+			continue
+		}
+		defer pooled.Release()
+		conns[name] = pooled.Conn()
+	}
+	var versions []string
+	for apiVersion := range s.config.Versions {
+		versions = append(versions, apiVersion)
+	}
+	sort.Strings(versions)
+	for _, apiVersion := range versions {
+		for k, f := range s.config.AppUserLocalParams {
+			s.ValidateSQLFile(conns[s.config.AuthDatabase], report, apiVersion, Route{Name: k, Type: "local param"}, requiredFile{[]string{"select", f}, 0})
+			// NOTE local params are inlined as subqueries
+			q, _, err := s.ReadSQL(apiVersion, "select", f)
+			if err != nil {
+				continue
+			}
+			_, err = TrimStatement(string(q))
+			if err != nil {
+				report.Add(RouteProblem{Version: apiVersion, Route: k, Type: "local param", File: "select/" + f, Problem: err.Error()})
+			}
+		}
+		for _, r := range routes {
+			for _, required := range s.RequiredSQLFiles(r) {
+				conn := conns[r.Database]
+				if required.elem[0] == "auth" && s.config.AuthDatabase != "" {
+					conn = conns[s.config.AuthDatabase]
+				}
+				s.ValidateSQLFile(conn, report, apiVersion, r, required)
+			}
+			if r.Type == "transaction" {
+				s.ValidateManifest(conns[r.Database], report, apiVersion, r)
+			}
+			// NOTE export SQL is wrapped in COPY
+			if r.Type == "export" {
+				q, _, err := s.ReadSQL(apiVersion, "export", r.Name+".sql")
+				if err != nil {
+					continue
+				}
+				_, err = TrimStatement(string(q))
+				if err != nil {
+					report.Add(RouteProblem{Version: apiVersion, Route: r.Name, Type: r.Type, File: "export/" + r.Name + ".sql", Problem: err.Error()})
+				}
+			}
+		}
+	}
+	for _, r := range routes {
+		s.ValidateSettings(conns[r.Database], report, r)
+	}
+	report.Valid = len(report.Problems) == 0
+	return report
+}
+
+func (s *servotron) ValidateSQLFile(conn *pgx.Conn, report *RouteReport, apiVersion string, r Route, required requiredFile) {
+	problem := RouteProblem{
+		Version: apiVersion,
+		Route:   r.Name,
+		Type:    r.Type,
+		File:    strings.Join(required.elem, "/"),
+	}
+	q, _, err := s.ReadSQL(apiVersion, required.elem...)
+	if err != nil {
+		problem.Problem = err.Error()
+		report.Add(problem)
+		return
+	}
+	if required.params < 0 {
+		return
+	}
+	n := CountPlaceholders(string(q))
+	if n != required.params {
+		problem.Problem = fmt.Sprintf("expected %d parameters, found %d", required.params, n)
+		report.Add(problem)
+		return
+	}
+	if conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.DBQueryTimeout)*time.Second)
+	defer cancel()
+	_, err = s.ParamOIDs(ctx, conn, string(q))
+	if err != nil {
+		problem.Problem = err.Error()
+		report.Add(problem)
+	}
+}
+
+// ValidateManifest checks the steps of a transaction route manifest
+func (s *servotron) ValidateManifest(conn *pgx.Conn, report *RouteReport, apiVersion string, r Route) {
+	b, _, err := s.ReadSQL(apiVersion, "transaction", r.Name, "manifest.json")
+	if err != nil {
+		// NOTE reported as a missing required file
+		return
+	}
+	manifest, err := ParseManifest(b)
+	if err != nil {
+		report.Add(RouteProblem{
+			Version: apiVersion,
+			Route:   r.Name,
+			Type:    r.Type,
+			File:    "transaction/" + r.Name + "/manifest.json",
+			Problem: err.Error(),
+		})
+		return
+	}
+	// NOTE step params name request params, steps are checked by ParseManifest
+	known := map[string]bool{"body": true, "auth": true}
+	for _, v := range PathVars(r.URLScheme) {
+		known[v] = true
+	}
+	for _, step := range manifest.Steps {
+		for _, param := range step.Params {
+			if !strings.HasPrefix(param, "steps.") && !known[param] {
+				report.Add(RouteProblem{
+					Version: apiVersion,
+					Route:   r.Name,
+					Type:    r.Type,
+					File:    "transaction/" + r.Name + "/manifest.json",
+					Problem: fmt.Sprintf("step %s: unknown param %q", step.Name, param),
+				})
+			}
+		}
+		required := requiredFile{[]string{"transaction", r.Name, step.File}, len(step.Params)}
+		s.ValidateSQLFile(conn, report, apiVersion, r, required)
+	}
+}
+
+// CheckSetting returns a problem with a route setting name
+func CheckSetting(name string) error {
+	if !settingPattern.MatchString(name) {
+		return fmt.Errorf("invalid setting name %q", name)
+	}
+	for _, reserved := range reservedSettings {
+		if strings.EqualFold(name, reserved) || (strings.HasSuffix(reserved, ".") && strings.HasPrefix(strings.ToLower(name), reserved)) {
+			return fmt.Errorf("reserved setting %q", name)
+		}
+	}
+	return nil
+}
+
+// ValidateSettings sets the route settings in a rolled back transaction, checking their names and values
+func (s *servotron) ValidateSettings(conn *pgx.Conn, report *RouteReport, r Route) {
+	if conn == nil || len(r.Settings) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.DBQueryTimeout)*time.Second)
+	defer cancel()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: err.Error()})
+		return
+	}
+	defer tx.Rollback(context.Background())
+	for k, v := range r.Settings {
+		if CheckSetting(k) != nil {
+			continue
+		}
+		// NOTE a failed set_config aborts the transaction, so each setting is checked in a savepoint
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: err.Error()})
+			return
+		}
+		_, err = sp.Exec(ctx, "select set_config($1,$2,true)", k, v)
+		if err != nil {
+			report.Add(RouteProblem{Route: r.Name, Type: r.Type, Problem: fmt.Sprintf("setting %s: %s", k, err)})
+		}
+		sp.Rollback(ctx)
+	}
+}
+
+func (r *RouteReport) Add(p RouteProblem) {
+	r.Problems = append(r.Problems, p)
+}
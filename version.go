@@ -0,0 +1,109 @@
+package servotron
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMissingVersion is returned when a request has no Version header and no DefaultVersion is configured
+	ErrMissingVersion = errors.New("missing Version header")
+	// ErrUnknownVersion is returned when the requested version is not declared in Versions
+	ErrUnknownVersion = errors.New("unknown version")
+	// ErrPathOutsideRoot is returned when a resolved SQL file path escapes SQLRoot
+	ErrPathOutsideRoot = errors.New("path outside of SQLRoot")
+)
+
+var versionPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// NOTE if version json changes, then the version struct must change
+// NOTE SQL files not found in a version are looked up in the version it extends
+// NOTE Sunset is an RFC 3339 timestamp
+type Version struct {
+	Description string
+	Extends     string
+	Deprecated  bool
+	Sunset      string
+}
+
+// ResolveVersion returns the declared API version for the request
+// NOTE requests without a Version header get the DefaultVersion
+func (s *servotron) ResolveVersion(r *http.Request) (string, error) {
+	apiVersion := r.Header.Get("Version")
+	if apiVersion == "" {
+		apiVersion = s.config.DefaultVersion
+	}
+	if apiVersion == "" {
+		return apiVersion, ErrMissingVersion
+	}
+	if !versionPattern.MatchString(apiVersion) {
+		return apiVersion, fmt.Errorf("%w: %q", ErrUnknownVersion, apiVersion)
+	}
+	if _, ok := s.config.Versions[apiVersion]; !ok {
+		return apiVersion, fmt.Errorf("%w: %q", ErrUnknownVersion, apiVersion)
+	}
+	return apiVersion, nil
+}
+
+// SQLPath joins the path elements under SQLRoot for the given version
+// NOTE the result is guaranteed to be inside SQLRoot
+func (s *servotron) SQLPath(apiVersion string, elem ...string) (string, error) {
+	root := filepath.Clean(s.config.SQLRoot)
+	result := filepath.Join(append([]string{root, apiVersion}, elem...)...)
+	rel, err := filepath.Rel(root, result)
+	if err != nil {
+		return result, ErrPathOutsideRoot
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return result, ErrPathOutsideRoot
+	}
+	return result, nil
+}
+
+// ReadSQL walks the version Extends chain and returns the first existing file and its path
+func (s *servotron) ReadSQL(apiVersion string, elem ...string) ([]byte, string, error) {
+	result := ""
+	for v := apiVersion; v != ""; v = s.config.Versions[v].Extends {
+		path, err := s.SQLPath(v, elem...)
+		if err != nil {
+			return nil, path, err
+		}
+		if result == "" {
+			result = path
+		}
+		q, err := s.files.ReadFile(path)
+		if err == nil {
+			return q, path, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, path, err
+		}
+	}
+	return nil, result, &fs.PathError{Op: "open", Path: result, Err: fs.ErrNotExist}
+}
+
+// VersionHeaders sets Deprecation and Sunset response headers for deprecated versions
+func (s *servotron) VersionHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiVersion, err := s.ResolveVersion(r)
+		if err == nil {
+			version := s.config.Versions[apiVersion]
+			if version.Deprecated {
+				w.Header().Set("Deprecation", "true")
+			}
+			if version.Sunset != "" {
+				sunset, err := time.Parse(time.RFC3339, version.Sunset)
+				if err == nil {
+					w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}